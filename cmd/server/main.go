@@ -1,44 +1,112 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
 	"github.com/joho/godotenv"
+	"gorm.io/gorm"
 
+	"rideaware/internal/account"
+	"rideaware/internal/apitoken"
+	"rideaware/internal/audit"
 	"rideaware/internal/auth"
 	"rideaware/internal/config"
+	"rideaware/internal/email"
 	"rideaware/internal/equipment"
 	"rideaware/internal/middleware"
+	"rideaware/internal/oauth"
+	"rideaware/internal/oauthserver"
+	"rideaware/internal/passwordpolicy"
+	"rideaware/internal/ratelimit"
+	"rideaware/internal/rbac"
+	"rideaware/internal/scope"
+	"rideaware/internal/takeout"
 	"rideaware/internal/user"
 	"rideaware/internal/workout"
+	"rideaware/migrations"
 	"rideaware/pkg/database"
+	"rideaware/pkg/utils"
 )
 
 func main() {
 	godotenv.Load()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Configuration:\n%s", cfg)
+
 	// Initialize database connection
-	database.Init()
-	defer database.Close()
+	db, err := database.Init(cfg.Database.DSN())
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Run migrations
-	if err := database.Migrate(
-		&user.User{},
-		&user.Profile{},
-		&user.PasswordReset{},
-		&user.Session{},
-		&equipment.Equipment{},
-		&workout.Workout{},
-	); err != nil {
+	migrator, err := database.NewMigrator(db, migrations.FS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := migrateOnStart(context.Background(), migrator, cfg.Database.AutoMigrate); err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
 
 	// Initialize JWT config
-	config.InitJWT()
+	if err := config.InitJWT(cfg.JWT); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := utils.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
+
+	passwordpolicy.SetDefault(passwordpolicy.New(cfg.Password))
+	workout.SetUploadDir(cfg.Storage.UploadDir)
+	takeout.SetExportDir(cfg.Storage.TakeoutDir)
+
+	rateLimitStore, err := ratelimit.NewStore(cfg.RateLimit.Store, db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mailer := email.NewService(cfg.Email)
+	auditor := audit.NewService(db)
+	users := user.NewService(db, cfg.Accounts, mailer, auditor)
+	shared := &services{
+		audit:       auditor,
+		users:       users,
+		tokens:      apitoken.NewService(db),
+		workouts:    workout.NewService(db, auditor),
+		takeout:     takeout.NewService(db, mailer),
+		oauth:       oauth.NewService(db, oauth.NewProviders(cfg.OAuthProviders)),
+		oauthServer: oauthserver.NewService(db, users, auditor),
+	}
+
+	// Background jobs stop when jobsCtx is cancelled during shutdown.
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	var jobs sync.WaitGroup
+	jobs.Go(func() { account.NewPurger(db, mailer).Run(jobsCtx, time.Hour) })
+	jobs.Go(func() { takeout.NewWorker(shared.takeout).Run(jobsCtx, 30*time.Second) })
+	if store, ok := rateLimitStore.(*ratelimit.PostgresStore); ok {
+		jobs.Go(func() { store.Run(jobsCtx, 10*time.Minute) })
+	}
 
 	r := chi.NewRouter()
 
@@ -51,67 +119,227 @@ func main() {
 		AllowedHeaders: []string{
 			"Accept", "Authorization", "Content-Type",
 		},
-		ExposedHeaders: []string{"Link"},
-		MaxAge:         300,
+		ExposedHeaders: []string{
+			"Link", "Retry-After",
+			"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy",
+		},
+		MaxAge: 300,
 	}))
 
+	r.Use(audit.Middleware)
+
 	// Routes
-	setupRoutes(r)
+	setupRoutes(r, shared, ratelimit.NewLimiter(rateLimitStore))
+
+	srv := &http.Server{
+		Addr:              ":" + strconv.Itoa(cfg.Server.Port),
+		Handler:           r,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Server running on port %d", cfg.Server.Port)
+		serverErr <- srv.ListenAndServe()
+	}()
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "5000"
+	exitCode := 0
+	select {
+	case err := <-serverErr:
+		log.Printf("Server failed: %v", err)
+		exitCode = 1
+	case <-signals.Done():
+		log.Println("Shutting down, send the signal again to force")
 	}
+	// Restore the default handling, so a second signal kills the process.
+	stopSignals()
 
-	log.Printf("Server running on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	shutdown(srv, &jobs, stopJobs, mailer, db, cfg.Server.ShutdownTimeout)
+	os.Exit(exitCode)
 }
 
-func setupRoutes(r *chi.Mux) {
+// shutdown stops the server in dependency order: no new requests or jobs,
+// then in-flight requests and jobs finish, then the clients they used are
+// closed. Requests and jobs still running after timeout are abandoned.
+func shutdown(srv *http.Server, jobs *sync.WaitGroup, stopJobs context.CancelFunc, mailer *email.Service, db *gorm.DB, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stopJobs()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Failed to drain requests: %v", err)
+		srv.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Background jobs did not stop in time")
+	}
+
+	mailer.Close()
+	if err := database.Close(db); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+	log.Println("Server stopped")
+}
+
+// services are shared by the routes and background jobs.
+type services struct {
+	audit       *audit.Service
+	users       *user.Service
+	tokens      *apitoken.Service
+	workouts    *workout.Service
+	takeout     *takeout.Service
+	oauth       *oauth.Service
+	oauthServer *oauthserver.Service
+}
+
+// Rate limit policies. Routes that send email get the tightest limits since
+// every request costs a Resend delivery.
+var (
+	signupLimit    = ratelimit.Policy{Name: "signup", Limit: 5, Period: time.Hour, Key: ratelimit.ByIP}
+	loginLimit     = ratelimit.Policy{Name: "login", Limit: 20, Period: time.Minute, Key: ratelimit.ByIP}
+	emailLimit     = ratelimit.Policy{Name: "email", Limit: 5, Period: time.Hour, Key: ratelimit.ByIP}
+	apiLimit       = ratelimit.Policy{Name: "api", Limit: 300, Period: time.Minute, Key: ratelimit.ByUser}
+	tokenLimit     = ratelimit.Policy{Name: "token", Limit: 120, Period: time.Minute, Key: ratelimit.ByToken}
+	userEmailLimit = ratelimit.Policy{Name: "user-email", Limit: 10, Period: time.Hour, Key: ratelimit.ByUser}
+)
+
+func setupRoutes(r *chi.Mux, s *services, limiter *ratelimit.Limiter) {
 	// Public routes
 	r.Get("/health", healthCheck)
 
+	authMiddleware := middleware.NewAuthMiddleware(s.users, s.tokens, s.audit)
+
 	// Auth routes
-	authHandler := auth.NewHandler()
-	r.Post("/api/signup", authHandler.Signup)
-	r.Post("/api/login", authHandler.Login)
-	r.Post("/api/logout", authHandler.Logout)
-	r.Post("/api/password-reset/request", authHandler.RequestPasswordReset)
-	r.Post("/api/password-reset/confirm", authHandler.ConfirmPasswordReset)
+	authHandler := auth.NewHandler(s.users, s.oauth)
+	r.With(limiter.Limit(signupLimit)).Post("/api/signup", authHandler.Signup)
+	r.With(limiter.Limit(emailLimit)).Post("/api/login/magic-link", authHandler.RequestMagicLink)
+	r.With(limiter.Limit(emailLimit)).Post("/api/password-reset/request", authHandler.RequestPasswordReset)
+	r.Get("/api/oauth/providers", authHandler.OAuthProviders)
+	r.With(authMiddleware.ProtectedRoute, authMiddleware.RequireSession, authMiddleware.DenyImpersonation).
+		Post("/api/logout", authHandler.Logout)
+	r.Get("/.well-known/jwks.json", authHandler.JWKS)
+
+	// Routes that check credentials or single-use tokens
+	r.Group(func(r chi.Router) {
+		r.Use(limiter.Limit(loginLimit))
+
+		r.Post("/api/login", authHandler.Login)
+		r.Post("/api/login/mfa", authHandler.LoginMFA)
+		r.Post("/api/login/magic-link/verify", authHandler.MagicLinkLogin)
+		r.Post("/api/oauth/{provider}/authorize", authHandler.OAuthAuthorize)
+		r.Post("/api/oauth/{provider}/callback", authHandler.OAuthCallback)
+		r.Post("/api/token/refresh", authHandler.RefreshToken)
+		r.Post("/api/account/unlock", authHandler.UnlockAccount)
+		r.Post("/api/account/restore", authHandler.RestoreAccount)
+		r.Post("/api/email/verify", authHandler.VerifyEmail)
+		r.Post("/api/email/change/confirm", authHandler.ConfirmEmailChange)
+		r.Post("/api/email/change/revert", authHandler.RevertEmailChange)
+		r.Post("/api/password-reset/confirm", authHandler.ConfirmPasswordReset)
+	})
+
+	// OAuth2 authorization server for third-party apps
+	oauthServerHandler := oauthserver.NewHandler(s.oauthServer)
+	r.With(limiter.Limit(loginLimit)).Post("/oauth2/token", oauthServerHandler.Token)
+	r.With(limiter.Limit(loginLimit)).Post("/oauth2/revoke", oauthServerHandler.Revoke)
+
+	takeoutHandler := takeout.NewHandler(s.takeout)
+	r.With(limiter.Limit(loginLimit)).Get("/api/takeout/download", takeoutHandler.Download)
 
 	// Protected routes
-	authMiddleware := middleware.NewAuthMiddleware()
 	r.Route("/api/protected", func(r chi.Router) {
-		r.Use(authMiddleware.ProtectedRoute)
+		r.Use(authMiddleware.ProtectedRoute, limiter.Limit(apiLimit), limiter.Limit(tokenLimit))
 
 		// User routes
-		userHandler := user.NewHandler()
-		r.Get("/profile", userHandler.GetProfile)
-		r.Put("/profile", userHandler.UpdateProfile)
+		userHandler := user.NewHandler(s.users)
+		r.With(authMiddleware.RequireScope(scope.ProfileRead)).Get("/profile", userHandler.GetProfile)
+		r.With(authMiddleware.RequireScope(scope.ProfileWrite)).Put("/profile", userHandler.UpdateProfile)
+
+		// Account and credential management is not available to
+		// personal access tokens or support staff impersonating the user
+		r.Group(func(r chi.Router) {
+			r.Use(authMiddleware.RequireSession, authMiddleware.DenyImpersonation)
+
+			r.Delete("/account", userHandler.DeleteAccount)
+			r.With(limiter.Limit(userEmailLimit)).Post("/takeout", takeoutHandler.RequestExport)
+			r.Get("/takeout", takeoutHandler.GetExports)
+			r.Post("/takeout/import", takeoutHandler.ImportArchive)
+			r.Get("/security/events", audit.NewHandler(s.audit).GetEvents)
+			r.Get("/sessions", userHandler.GetSessions)
+			r.Delete("/sessions", userHandler.RevokeSession)
+			r.Put("/password", authHandler.ChangePassword)
+			r.With(limiter.Limit(userEmailLimit)).Post("/email/change", authHandler.RequestEmailChange)
+			r.With(limiter.Limit(userEmailLimit)).Post("/email/verify/resend", authHandler.ResendVerificationEmail)
+			r.Post("/oauth/{provider}/link", authHandler.OAuthLink)
+			r.Post("/oauth/{provider}/link/callback", authHandler.OAuthLinkCallback)
+
+			// Two-factor authentication
+			r.Post("/mfa/totp", userHandler.EnrollTOTP)
+			r.Post("/mfa/totp/confirm", userHandler.ConfirmTOTP)
+			r.Delete("/mfa/totp", userHandler.DisableTOTP)
+			r.Post("/mfa/recovery-codes", userHandler.RegenerateRecoveryCodes)
+
+			// Personal access tokens
+			tokenHandler := apitoken.NewHandler(s.tokens)
+			r.With(authMiddleware.RequireVerifiedEmail).Post("/tokens", tokenHandler.CreateToken)
+			r.Get("/tokens", tokenHandler.GetTokens)
+			r.Delete("/tokens", tokenHandler.RevokeToken)
+
+			// OAuth2 clients, consent and authorized apps
+			r.With(authMiddleware.RequireVerifiedEmail).Post("/oauth2/clients", oauthServerHandler.RegisterClient)
+			r.Get("/oauth2/clients", oauthServerHandler.GetClients)
+			r.Delete("/oauth2/clients", oauthServerHandler.DeleteClient)
+			r.Get("/oauth2/authorize", oauthServerHandler.GetConsent)
+			r.Post("/oauth2/authorize", oauthServerHandler.Authorize)
+			r.Get("/oauth2/grants", oauthServerHandler.GetGrants)
+			r.Delete("/oauth2/grants", oauthServerHandler.RevokeGrant)
+		})
 
 		// Equipment routes
 		equipmentHandler := equipment.NewHandler()
-		r.Post("/equipment", equipmentHandler.CreateEquipment)
-		r.Get("/equipment", equipmentHandler.GetEquipment)
-		r.Put("/equipment", equipmentHandler.UpdateEquipment)
-		r.Delete("/equipment", equipmentHandler.DeleteEquipment)
+		r.With(authMiddleware.RequireScope(scope.EquipmentWrite)).Post("/equipment", equipmentHandler.CreateEquipment)
+		r.With(authMiddleware.RequireScope(scope.EquipmentRead)).Get("/equipment", equipmentHandler.GetEquipment)
+		r.With(authMiddleware.RequireScope(scope.EquipmentWrite)).Put("/equipment", equipmentHandler.UpdateEquipment)
+		r.With(authMiddleware.RequireScope(scope.EquipmentWrite)).Delete("/equipment", equipmentHandler.DeleteEquipment)
 
 		// Training zones
-		r.Get("/zones", equipmentHandler.GetTrainingZones)
+		r.With(authMiddleware.RequireScope(scope.ProfileRead)).Get("/zones", equipmentHandler.GetTrainingZones)
 
 		// Workout routes
-		workoutHandler := workout.NewHandler()
-		r.Post("/workouts", workoutHandler.CreateWorkout)
-		r.Get("/workouts", workoutHandler.GetWorkouts)
-		r.Get("/workouts/month", workoutHandler.GetWorkoutsByMonth)
-		r.Put("/workouts", workoutHandler.UpdateWorkout)
-		r.Delete("/workouts", workoutHandler.DeleteWorkout)
+		workoutHandler := workout.NewHandler(s.workouts)
+		r.With(authMiddleware.RequireScope(scope.WorkoutsWrite)).Post("/workouts", workoutHandler.CreateWorkout)
+		r.With(authMiddleware.RequireScope(scope.WorkoutsRead)).Get("/workouts", workoutHandler.GetWorkouts)
+		r.With(authMiddleware.RequireScope(scope.WorkoutsRead)).Get("/workouts/month", workoutHandler.GetWorkoutsByMonth)
+		r.With(authMiddleware.RequireScope(scope.WorkoutsWrite)).Put("/workouts", workoutHandler.UpdateWorkout)
+		r.With(authMiddleware.RequireScope(scope.WorkoutsWrite)).Delete("/workouts", workoutHandler.DeleteWorkout)
 		r.Get("/workout-types", workoutHandler.GetWorkoutTypes)
-		r.Post("/workouts/upload", workoutHandler.UploadWorkoutFile)
+		r.With(authMiddleware.RequireScope(scope.WorkoutsWrite), authMiddleware.RequireVerifiedEmail).
+			Post("/workouts/upload", workoutHandler.UploadWorkoutFile)
+	})
+
+	// Admin routes
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(authMiddleware.ProtectedRoute, authMiddleware.RequireSession, authMiddleware.DenyImpersonation, limiter.Limit(apiLimit))
+
+		userHandler := user.NewHandler(s.users)
+		r.With(authMiddleware.RequirePermission(rbac.RolesWrite)).Put("/users/role", userHandler.SetUserRole)
+		r.With(authMiddleware.RequirePermission(rbac.UsersImpersonate)).Post("/users/impersonate", userHandler.Impersonate)
 	})
 }
 
 func healthCheck(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
-}
\ No newline at end of file
+}
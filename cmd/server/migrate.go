@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"rideaware/internal/config"
+	"rideaware/migrations"
+	"rideaware/pkg/database"
+)
+
+// runMigrate implements "server migrate [flags] status|up|down|redo".
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s migrate [flags] status|up|down|redo\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	cfg, err := config.LoadDatabase(fs, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db, err := database.Init(cfg.Database.DSN())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer database.Close(db)
+
+	migrator, err := database.NewMigrator(db, migrations.FS)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	switch fs.Arg(0) {
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "MIGRATION\tAPPLIED")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\n", status.Migration, applied)
+		}
+		w.Flush()
+
+	case "up":
+		applied, err := migrator.Up(ctx)
+		logApplied(applied)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(applied) == 0 {
+			log.Println("Database is up to date")
+		}
+
+	case "down", "redo":
+		var migration *database.Migration
+		if fs.Arg(0) == "down" {
+			migration, err = migrator.Down(ctx)
+		} else {
+			migration, err = migrator.Redo(ctx)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if migration == nil {
+			log.Println("No migrations are applied")
+			return
+		}
+		if fs.Arg(0) == "down" {
+			log.Printf("Reverted migration %s", migration)
+		} else {
+			log.Printf("Redid migration %s", migration)
+		}
+
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// migrateOnStart applies pending migrations when the server starts, or
+// refuses to start if they are pending and auto_migrate is off.
+func migrateOnStart(ctx context.Context, migrator *database.Migrator, auto bool) error {
+	if !auto {
+		pending, err := migrator.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			names := make([]string, len(pending))
+			for i, migration := range pending {
+				names[i] = migration.String()
+			}
+			return fmt.Errorf("database has pending migrations (%s); run \"%s migrate up\" first",
+				strings.Join(names, ", "), os.Args[0])
+		}
+		return nil
+	}
+
+	applied, err := migrator.Up(ctx)
+	logApplied(applied)
+	return err
+}
+
+func logApplied(applied []database.Migration) {
+	for _, migration := range applied {
+		log.Printf("Applied migration %s", migration)
+	}
+}
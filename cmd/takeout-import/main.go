@@ -0,0 +1,76 @@
+// Command takeout-import loads a takeout archive exported from another
+// RideAware instance into an existing account, for moving athletes between
+// instances in bulk:
+//
+//	takeout-import -user alice rideaware-takeout-12.zip
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/joho/godotenv"
+
+	"rideaware/internal/config"
+	"rideaware/internal/email"
+	"rideaware/internal/takeout"
+	"rideaware/internal/user"
+	"rideaware/internal/workout"
+	"rideaware/pkg/database"
+)
+
+func main() {
+	username := flag.String("user", "", "username of the account to import into")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s -user <username> <archive.zip>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	godotenv.Load()
+
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *username == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := database.Init(cfg.Database.DSN())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer database.Close(db)
+
+	workout.SetUploadDir(cfg.Storage.UploadDir)
+
+	target, err := user.NewRepository(db).GetUserByUsername(*username)
+	if err != nil {
+		log.Fatalf("Failed to find user %q: %v", *username, err)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to open archive: %v", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Fatalf("Failed to read archive: %v", err)
+	}
+
+	report, err := takeout.NewService(db, email.NewService(cfg.Email)).ImportArchive(target.ID, f, info.Size())
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
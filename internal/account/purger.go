@@ -0,0 +1,88 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"rideaware/internal/email"
+	"rideaware/internal/takeout"
+	"rideaware/internal/workout"
+
+	"gorm.io/gorm"
+)
+
+// purgeBatchSize caps how many accounts are purged per run.
+const purgeBatchSize = 100
+
+// Purger permanently deletes accounts whose deletion grace period has passed
+// and tells their owners once it is done.
+type Purger struct {
+	repo  *Repository
+	email *email.Service
+}
+
+func NewPurger(db *gorm.DB, mailer *email.Service) *Purger {
+	return &Purger{
+		repo:  NewRepository(db),
+		email: mailer,
+	}
+}
+
+// Run purges due accounts every interval until ctx is cancelled.
+func (p *Purger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.PurgeDue(ctx); err != nil {
+			log.Printf("Account purge failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeDue deletes every account that is past its grace period. A failure
+// on one account is logged and does not stop the others. It stops between
+// accounts once ctx is cancelled; the rest are purged on the next run.
+func (p *Purger) PurgeDue(ctx context.Context) error {
+	now := time.Now()
+	users, err := p.repo.GetUsersDueForPurge(now, purgeBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, due := range users {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		u, err := p.repo.PurgeUser(due.ID, now)
+		if err != nil {
+			if !errors.Is(err, errNotDue) {
+				log.Printf("Failed to purge user %d: %v", due.ID, err)
+			}
+			continue
+		}
+
+		if err := workout.RemoveUserUploads(u.ID); err != nil {
+			log.Printf("Failed to remove uploads of user %d: %v", u.ID, err)
+		}
+		if err := takeout.RemoveUserExports(u.ID); err != nil {
+			log.Printf("Failed to remove takeout archives of user %d: %v", u.ID, err)
+		}
+
+		log.Printf("Purged user %d", u.ID)
+		if err := p.email.SendAccountDeletedEmail(u.Email, u.Username); err != nil {
+			log.Printf("Failed to send deletion confirmation for user %d: %v", u.ID, err)
+		}
+	}
+
+	return nil
+}
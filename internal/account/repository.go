@@ -0,0 +1,119 @@
+package account
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"rideaware/internal/apitoken"
+	"rideaware/internal/audit"
+	"rideaware/internal/oauth"
+	"rideaware/internal/oauthserver"
+	"rideaware/internal/profile"
+	"rideaware/internal/takeout"
+	"rideaware/internal/user"
+	"rideaware/internal/workout"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errNotDue is returned by PurgeUser when the deletion was cancelled or
+// postponed after the user was picked for purging.
+var errNotDue = errors.New("account is not due for purging")
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{db: db}
+}
+
+// GetUsersDueForPurge returns accounts whose deletion grace period is over.
+func (r *Repository) GetUsersDueForPurge(now time.Time, limit int) ([]user.User, error) {
+	var users []user.User
+	if err := r.db.Where("deletion_scheduled_for <= ?", now).
+		Order("deletion_scheduled_for").
+		Limit(limit).
+		Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// PurgeUser permanently deletes a user and every row they own in a single
+// transaction, and anonymises their audit events. The user row is locked
+// first so a concurrent restore either wins or waits for the purge to finish.
+func (r *Repository) PurgeUser(userID uint, now time.Time) (*user.User, error) {
+	var u user.User
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND deletion_scheduled_for <= ?", userID, now).
+			First(&u).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errNotDue
+			}
+			return err
+		}
+
+		// Apps the user registered go away with them, so every session
+		// other users granted those apps is revoked too.
+		if err := tx.Model(&user.Session{}).
+			Where("client_id IN (?) AND revoked_at IS NULL",
+				tx.Model(&oauthserver.Client{}).Select("client_id").Where("user_id = ?", u.ID)).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+
+		// The audit log is append-only, so the user's events are kept but
+		// no longer point at them or carry their details.
+		if err := tx.Model(&audit.Event{}).Where("user_id = ?", u.ID).Updates(map[string]interface{}{
+			"user_id":    nil,
+			"ip_address": "",
+			"user_agent": "",
+			"changes":    gorm.Expr("NULL"),
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&audit.Event{}).Where("actor_id = ?", u.ID).Updates(map[string]interface{}{
+			"actor_id":   nil,
+			"ip_address": "",
+			"user_agent": "",
+		}).Error; err != nil {
+			return err
+		}
+
+		owned := []interface{}{
+			&workout.Workout{},
+			&profile.Equipment{},
+			&apitoken.PersonalAccessToken{},
+			&takeout.Export{},
+			&oauth.LoginState{},
+			&oauthserver.Client{},
+			&oauthserver.AuthorizationCode{},
+			&user.Identity{},
+			&user.RecoveryCode{},
+			&user.ActionToken{},
+			&user.Session{},
+			&user.PasswordReset{},
+			&user.Profile{},
+		}
+		for _, model := range owned {
+			if err := tx.Where("user_id = ?", u.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("key = ?", "user:"+strings.ToLower(u.Username)).
+			Delete(&user.LoginThrottle{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Delete(&u).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
@@ -0,0 +1,45 @@
+package apitoken
+
+import (
+	"strings"
+	"time"
+
+	"rideaware/internal/middleware"
+)
+
+// TokenPrefix marks personal access tokens so they can be told apart from
+// JWTs in the Authorization header.
+const TokenPrefix = middleware.PersonalAccessTokenPrefix
+
+// PersonalAccessToken is a long-lived, scoped credential for scripts and
+// integrations. Only the SHA-256 hash of the token is stored; Prefix keeps
+// its first characters so users can recognise it.
+type PersonalAccessToken struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	Name       string     `gorm:"not null" json:"name"`
+	Prefix     string     `gorm:"not null" json:"prefix"`
+	TokenHash  string     `gorm:"uniqueIndex;not null" json:"-"`
+	Scopes     string     `gorm:"not null" json:"-"` // space separated
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (PersonalAccessToken) TableName() string {
+	return "personal_access_tokens"
+}
+
+// ScopeList returns the scopes granted to the token
+func (t *PersonalAccessToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+// IsValid checks if the token is neither revoked nor expired
+func (t *PersonalAccessToken) IsValid() bool {
+	if t.RevokedAt != nil {
+		return false
+	}
+	return t.ExpiresAt == nil || time.Now().Before(*t.ExpiresAt)
+}
@@ -0,0 +1,62 @@
+package apitoken
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{db: db}
+}
+
+func (r *Repository) CreateToken(token *PersonalAccessToken) error {
+	return r.db.Create(token).Error
+}
+
+func (r *Repository) GetTokenByHash(hash string) (*PersonalAccessToken, error) {
+	var token PersonalAccessToken
+	if err := r.db.Where("token_hash = ?", hash).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("token not found")
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (r *Repository) GetUserTokens(userID uint) ([]PersonalAccessToken, error) {
+	var tokens []PersonalAccessToken
+	if err := r.db.Where("user_id = ? AND revoked_at IS NULL", userID).
+		Order("created_at DESC").
+		Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (r *Repository) RevokeToken(id, userID uint) error {
+	result := r.db.Model(&PersonalAccessToken{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("token not found")
+	}
+	return nil
+}
+
+// TouchToken records a use of the token, at most once per interval.
+func (r *Repository) TouchToken(id uint, interval time.Duration) error {
+	now := time.Now()
+	return r.db.Model(&PersonalAccessToken{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", id, now.Add(-interval)).
+		Update("last_used_at", now).Error
+}
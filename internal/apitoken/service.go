@@ -0,0 +1,121 @@
+package apitoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"rideaware/internal/config"
+	"rideaware/internal/scope"
+	"rideaware/internal/user"
+
+	"gorm.io/gorm"
+)
+
+// lastUsedInterval limits how often a token's last-used time is written.
+const lastUsedInterval = time.Minute
+
+type Service struct {
+	repo  *Repository
+	users *user.Repository
+}
+
+func NewService(db *gorm.DB) *Service {
+	return &Service{
+		repo:  NewRepository(db),
+		users: user.NewRepository(db),
+	}
+}
+
+// CreateToken issues a token with the given scopes. The plaintext token is
+// only returned here and cannot be recovered later.
+func (s *Service) CreateToken(userID uint, name string, scopes []string, expiresIn time.Duration) (string, *PersonalAccessToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, errors.New("name is required")
+	}
+	if len(scopes) == 0 {
+		return "", nil, errors.New("at least one scope is required")
+	}
+	for _, sc := range scopes {
+		if !scope.Valid(sc) {
+			return "", nil, fmt.Errorf("unknown scope %q", sc)
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	raw := TokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	token := &PersonalAccessToken{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    raw[:len(TokenPrefix)+6],
+		TokenHash: hashToken(raw),
+		Scopes:    strings.Join(scopes, " "),
+	}
+	if expiresIn > 0 {
+		expiresAt := time.Now().Add(expiresIn)
+		token.ExpiresAt = &expiresAt
+	}
+
+	if err := s.repo.CreateToken(token); err != nil {
+		return "", nil, err
+	}
+
+	return raw, token, nil
+}
+
+func (s *Service) GetUserTokens(userID uint) ([]PersonalAccessToken, error) {
+	return s.repo.GetUserTokens(userID)
+}
+
+func (s *Service) RevokeToken(id, userID uint) error {
+	return s.repo.RevokeToken(id, userID)
+}
+
+// AuthenticateToken implements middleware.TokenAuthenticator. It resolves a
+// personal access token to claims for its owner restricted to its scopes.
+func (s *Service) AuthenticateToken(raw string) (*config.CustomClaims, error) {
+	token, err := s.repo.GetTokenByHash(hashToken(raw))
+	if err != nil {
+		return nil, errors.New("invalid token")
+	}
+	if !token.IsValid() {
+		return nil, errors.New("token has expired or been revoked")
+	}
+
+	owner, err := s.users.GetUserByID(token.UserID)
+	if err != nil {
+		return nil, errors.New("invalid token")
+	}
+	if !owner.IsActive {
+		return nil, errors.New("account is disabled")
+	}
+
+	if err := s.repo.TouchToken(token.ID, lastUsedInterval); err != nil {
+		log.Printf("Failed to record use of token %d: %v", token.ID, err)
+	}
+
+	return &config.CustomClaims{
+		UserID:        owner.ID,
+		Email:         owner.Email,
+		EmailVerified: owner.IsEmailVerified(),
+		Username:      owner.Username,
+		TokenType:     "personal_access_token",
+		Scopes:        token.ScopeList(),
+	}, nil
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"time"
+)
+
+// Event records one security relevant action. ActorID is the user who
+// performed it and UserID the account it affected; they differ for admin
+// actions and are both nil when a login names an unknown user. Events are
+// only ever inserted, except that purging an account anonymises its events.
+type Event struct {
+	ID        uint    `gorm:"primaryKey" json:"id"`
+	ActorID   *uint   `gorm:"index" json:"actor_id"`
+	UserID    *uint   `gorm:"index" json:"user_id"`
+	Action    string  `gorm:"not null;index" json:"action"`
+	IPAddress string  `gorm:"default:''" json:"ip_address"`
+	UserAgent string  `gorm:"default:''" json:"user_agent"`
+	Changes   Changes `gorm:"type:jsonb" json:"changes,omitempty"`
+	// Request is the method and path of a request made while impersonating.
+	Request   string    `gorm:"default:''" json:"request,omitempty"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+func (Event) TableName() string {
+	return "audit_events"
+}
+
+// Change is the value of one field before and after an action.
+type Change struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// Changes maps field names to their change.
+type Changes map[string]Change
+
+// Scan implements sql.Scanner interface
+func (c *Changes) Scan(value interface{}) error {
+	if value == nil {
+		*c = nil
+		return nil
+	}
+	bytes := value.([]byte)
+	return json.Unmarshal(bytes, c)
+}
+
+// Value implements driver.Valuer interface
+func (c Changes) Value() (driver.Value, error) {
+	if c == nil {
+		return nil, nil
+	}
+	return json.Marshal(c)
+}
+
+const (
+	ActionSignup                   = "account.created"
+	ActionLogin                    = "login.succeeded"
+	ActionLoginFailed              = "login.failed"
+	ActionAccountLocked            = "account.locked"
+	ActionAccountUnlocked          = "account.unlocked"
+	ActionEmailVerified            = "email.verified"
+	ActionEmailChangeRequested     = "email.change_requested"
+	ActionEmailChanged             = "email.changed"
+	ActionEmailChangeReverted      = "email.change_reverted"
+	ActionPasswordResetRequested   = "password.reset_requested"
+	ActionPasswordReset            = "password.reset"
+	ActionPasswordChanged          = "password.changed"
+	ActionMFAEnabled               = "mfa.enabled"
+	ActionMFADisabled              = "mfa.disabled"
+	ActionRecoveryCodesRegenerated = "mfa.recovery_codes_regenerated"
+	ActionSessionRevoked           = "session.revoked"
+	ActionAllSessionsRevoked       = "session.revoked_all"
+	ActionIdentityLinked           = "identity.linked"
+	ActionRoleChanged              = "role.changed"
+	ActionDeletionScheduled        = "account.deletion_scheduled"
+	ActionAccountRestored          = "account.restored"
+	ActionProfileUpdated           = "profile.updated"
+	ActionWorkoutUpdated           = "workout.updated"
+	ActionWorkoutDeleted           = "workout.deleted"
+	ActionOAuthClientRegistered    = "oauth.client_registered"
+	ActionOAuthClientDeleted       = "oauth.client_deleted"
+	ActionOAuthAuthorized          = "oauth.authorized"
+	ActionOAuthGrantRevoked        = "oauth.grant_revoked"
+	ActionImpersonationStarted     = "impersonation.started"
+	ActionImpersonatedRequest      = "impersonation.request"
+)
@@ -0,0 +1,30 @@
+package audit
+
+import "gorm.io/gorm"
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{db: db}
+}
+
+func (r *Repository) CreateEvent(event *Event) error {
+	return r.db.Create(event).Error
+}
+
+// GetUserEvents returns up to limit events affecting userID, newest first.
+// A non-zero beforeID continues a previous page.
+func (r *Repository) GetUserEvents(userID uint, beforeID uint, limit int) ([]Event, error) {
+	query := r.db.Where("user_id = ?", userID)
+	if beforeID > 0 {
+		query = query.Where("id < ?", beforeID)
+	}
+
+	var events []Event
+	if err := query.Order("id DESC").Limit(limit).Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,134 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+
+	"rideaware/internal/config"
+	"rideaware/internal/middleware"
+	"rideaware/pkg/utils"
+
+	"gorm.io/gorm"
+)
+
+const maxEventsPerPage = 100
+
+type requestInfoKey struct{}
+
+type requestInfo struct {
+	ipAddress string
+	userAgent string
+}
+
+// Middleware remembers the client address and user agent of the request so
+// events recorded while handling it carry them.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, requestInfo{
+			ipAddress: utils.ClientIP(r),
+			userAgent: r.UserAgent(),
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type Service struct {
+	repo *Repository
+}
+
+func NewService(db *gorm.DB) *Service {
+	return &Service{
+		repo: NewRepository(db),
+	}
+}
+
+// Record stores event, filling in the request details from ctx. Without an
+// explicit ActorID the authenticated user of the request is the actor, or
+// the admin behind an impersonation token.
+// Failures are logged rather than returned so auditing never blocks the
+// action itself.
+func (s *Service) Record(ctx context.Context, event Event) {
+	if info, ok := ctx.Value(requestInfoKey{}).(requestInfo); ok {
+		event.IPAddress = info.ipAddress
+		event.UserAgent = info.userAgent
+	}
+	if event.ActorID == nil {
+		if claims, ok := ctx.Value(middleware.UserContextKey).(*config.CustomClaims); ok {
+			actorID := claims.UserID
+			if claims.ImpersonatorID != 0 {
+				actorID = claims.ImpersonatorID
+			}
+			event.ActorID = &actorID
+		}
+	}
+
+	if err := s.repo.CreateEvent(&event); err != nil {
+		log.Printf("Failed to record audit event %s: %v", event.Action, err)
+	}
+}
+
+// RecordImpersonatedRequest implements middleware.ImpersonationAuditor.
+func (s *Service) RecordImpersonatedRequest(ctx context.Context, impersonatorID, userID uint, request string) {
+	s.Record(ctx, Event{
+		ActorID: &impersonatorID,
+		UserID:  &userID,
+		Action:  ActionImpersonatedRequest,
+		Request: request,
+	})
+}
+
+// GetUserEvents returns a page of the events affecting userID.
+func (s *Service) GetUserEvents(userID, beforeID uint, limit int) ([]Event, error) {
+	if limit <= 0 || limit > maxEventsPerPage {
+		limit = maxEventsPerPage
+	}
+	return s.repo.GetUserEvents(userID, beforeID, limit)
+}
+
+// UserEvent is an event about userID performed by the request's user.
+func UserEvent(userID uint, action string) Event {
+	return Event{UserID: &userID, Action: action}
+}
+
+// Diff compares the JSON form of before and after and returns the fields
+// that differ. Either may be nil for a creation or deletion. Fields hidden
+// from JSON, such as password hashes, never show up, and updated_at is
+// skipped as it changes on every save.
+func Diff(before, after interface{}) Changes {
+	from := toFields(before)
+	to := toFields(after)
+
+	changes := Changes{}
+	for field, value := range from {
+		if !reflect.DeepEqual(value, to[field]) {
+			changes[field] = Change{From: value, To: to[field]}
+		}
+	}
+	for field, value := range to {
+		if _, ok := from[field]; !ok {
+			changes[field] = Change{From: nil, To: value}
+		}
+	}
+	delete(changes, "updated_at")
+
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+func toFields(v interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil() {
+		return fields
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fields
+	}
+	json.Unmarshal(data, &fields)
+	return fields
+}
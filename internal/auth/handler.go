@@ -2,42 +2,90 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
 
 	"rideaware/internal/config"
+	"rideaware/internal/middleware"
+	"rideaware/internal/oauth"
+	"rideaware/internal/passwordpolicy"
 	"rideaware/internal/user"
+	"rideaware/pkg/utils"
 )
 
 type Handler struct {
-	userService *user.Service
+	userService  *user.Service
+	oauthService *oauth.Service
 }
 
-func NewHandler() *Handler {
+func NewHandler(userService *user.Service, oauthService *oauth.Service) *Handler {
 	return &Handler{
-		userService: user.NewService(),
+		userService:  userService,
+		oauthService: oauthService,
 	}
 }
 
 type SignupRequest struct {
-	Username  string `json:"username"`
-	Password  string `json:"password"`
-	Email     string `json:"email"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Email      string `json:"email"`
+	FirstName  string `json:"first_name"`
+	LastName   string `json:"last_name"`
+	DeviceName string `json:"device_name"`
 }
 
 type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name"`
 }
 
-type TokenResponse struct {
-	AccessToken  string `json:"access_token"`
+type OAuthCallbackRequest struct {
+	Code        string `json:"code"`
+	State       string `json:"state"`
+	StateSecret string `json:"state_secret"`
+	DeviceName  string `json:"device_name"`
+}
+
+type MagicLinkLoginRequest struct {
+	Token      string `json:"token"`
+	DeviceName string `json:"device_name"`
+}
+
+type MFALoginRequest struct {
+	MFAToken   string `json:"mfa_token"`
+	Code       string `json:"code"`
+	DeviceName string `json:"device_name"`
+}
+
+type MFAChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type RefreshRequest struct {
 	RefreshToken string `json:"refresh_token"`
-	ExpiresIn    int    `json:"expires_in"`
-	UserID       uint   `json:"user_id"`
-	Username     string `json:"username"`
-	Email        string `json:"email"`
+}
+
+type LogoutRequest struct {
+	AllDevices bool `json:"all_devices"`
+}
+
+type TokenResponse struct {
+	AccessToken   string `json:"access_token"`
+	RefreshToken  string `json:"refresh_token"`
+	ExpiresIn     int    `json:"expires_in"`
+	UserID        uint   `json:"user_id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Role          string `json:"role"`
 }
 
 func (h *Handler) Signup(w http.ResponseWriter, r *http.Request) {
@@ -49,7 +97,71 @@ func (h *Handler) Signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newUser, err := h.userService.CreateUser(req.Username, req.Password, req.Email, req.FirstName, req.LastName)
+	newUser, err := h.userService.CreateUser(r.Context(), req.Username, req.Password, req.Email, req.FirstName, req.LastName)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	h.startSession(w, r, http.StatusCreated, newUser, req.DeviceName)
+}
+
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	u, err := h.userService.VerifyUser(r.Context(), req.Username, req.Password, utils.ClientIP(r))
+	if err != nil {
+		writeLoginError(w, err)
+		return
+	}
+
+	h.completeLogin(w, r, u, req.DeviceName)
+}
+
+// LoginMFA POST /api/login/mfa
+func (h *Handler) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	claims, err := config.VerifyToken(req.MFAToken)
+	if err != nil || claims.TokenType != "mfa_challenge" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired mfa token"})
+		return
+	}
+
+	u, err := h.userService.VerifyLoginMFA(r.Context(), claims.UserID, req.Code, utils.ClientIP(r))
+	if err != nil {
+		writeLoginError(w, err)
+		return
+	}
+
+	h.startSession(w, r, http.StatusOK, u, req.DeviceName)
+}
+
+// OAuthProviders GET /api/oauth/providers
+func (h *Handler) OAuthProviders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{
+		"providers": h.oauthService.Providers(),
+	})
+}
+
+// OAuthAuthorize POST /api/oauth/{provider}/authorize
+func (h *Handler) OAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	authURL, stateSecret, err := h.oauthService.AuthorizationURL(r.Context(), chi.URLParam(r, "provider"), nil)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
@@ -57,23 +169,303 @@ func (h *Handler) Signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	accessToken, _ := config.GenerateAccessToken(newUser.ID, newUser.Email, newUser.Username)
-	refreshToken, _ := config.GenerateRefreshToken(newUser.ID, newUser.Email, newUser.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"authorization_url": authURL,
+		"state_secret":      stateSecret,
+	})
+}
+
+// OAuthLink POST /api/protected/oauth/{provider}/link
+func (h *Handler) OAuthLink(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	authURL, stateSecret, err := h.oauthService.AuthorizationURL(r.Context(), chi.URLParam(r, "provider"), &claims.UserID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(TokenResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		ExpiresIn:    900,
-		UserID:       newUser.ID,
-		Username:     newUser.Username,
-		Email:        newUser.Email,
+	json.NewEncoder(w).Encode(map[string]string{
+		"authorization_url": authURL,
+		"state_secret":      stateSecret,
 	})
 }
 
-func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
-	var req LoginRequest
+// OAuthCallback POST /api/oauth/{provider}/callback
+func (h *Handler) OAuthCallback(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeOAuthCallback(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := h.oauthService.Complete(r.Context(), chi.URLParam(r, "provider"),
+		req.Code, req.State, req.StateSecret, nil)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	u, err := h.userService.LoginWithIdentity(r.Context(), externalIdentity(result.UserInfo))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	h.completeLogin(w, r, u, req.DeviceName)
+}
+
+// OAuthLinkCallback POST /api/protected/oauth/{provider}/link/callback
+func (h *Handler) OAuthLinkCallback(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	req, ok := decodeOAuthCallback(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := h.oauthService.Complete(r.Context(), chi.URLParam(r, "provider"),
+		req.Code, req.State, req.StateSecret, &claims.UserID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := h.userService.LinkIdentity(r.Context(), claims.UserID, externalIdentity(result.UserInfo)); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Account linked"})
+}
+
+func decodeOAuthCallback(w http.ResponseWriter, r *http.Request) (OAuthCallbackRequest, bool) {
+	var req OAuthCallbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+		req.Code == "" || req.State == "" || req.StateSecret == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return req, false
+	}
+	return req, true
+}
+
+func externalIdentity(info oauth.UserInfo) user.ExternalIdentity {
+	return user.ExternalIdentity{
+		Provider:      info.Provider,
+		Subject:       info.Subject,
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified,
+		Username:      info.Username,
+	}
+}
+
+// RefreshToken POST /api/token/refresh
+func (h *Handler) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	claims, err := config.VerifyToken(req.RefreshToken)
+	if err != nil || claims.TokenType != "refresh" || claims.ID == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired refresh token"})
+		return
+	}
+
+	u, session, err := h.userService.RefreshSession(claims.ID, "", sessionInfo(r, ""))
+	if err != nil || u.ID != claims.UserID {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		if errors.Is(err, user.ErrRefreshTokenReused) {
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired refresh token"})
+		return
+	}
+
+	h.writeTokens(w, http.StatusOK, u, session)
+}
+
+// UnlockAccount POST /api/account/unlock
+func (h *Handler) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if err := h.userService.UnlockAccount(r.Context(), req.Token); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Account unlocked",
+	})
+}
+
+// RestoreAccount POST /api/account/restore
+func (h *Handler) RestoreAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if err := h.userService.RestoreAccount(r.Context(), req.Token); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Account restored, you can log in again",
+	})
+}
+
+// VerifyEmail POST /api/email/verify
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if _, err := h.userService.VerifyEmail(r.Context(), req.Token); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Email verified",
+	})
+}
+
+// ResendVerificationEmail POST /api/protected/email/verify/resend
+func (h *Handler) ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	if err := h.userService.ResendVerificationEmail(claims.UserID); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, user.ErrVerificationThrottled) {
+			status = http.StatusTooManyRequests
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Verification email sent",
+	})
+}
+
+// ChangePassword PUT /api/protected/password
+func (h *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if err := h.userService.ChangePassword(r.Context(), claims.UserID, claims.SessionID, req.CurrentPassword, req.NewPassword); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Password changed, other devices have been signed out",
+	})
+}
+
+// RequestEmailChange POST /api/protected/email/change
+func (h *Handler) RequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	var req struct {
+		NewEmail string `json:"new_email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if err := h.userService.RequestEmailChange(r.Context(), claims.UserID, req.Password, req.NewEmail); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, user.ErrVerificationThrottled) {
+			status = http.StatusTooManyRequests
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Confirmation email sent to the new address",
+	})
+}
+
+// ConfirmEmailChange POST /api/email/change/confirm
+func (h *Handler) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
@@ -81,28 +473,86 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := h.userService.VerifyUser(req.Username, req.Password)
+	u, err := h.userService.ConfirmEmailChange(r.Context(), req.Token)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
 
-	accessToken, _ := config.GenerateAccessToken(user.ID, user.Email, user.Username)
-	refreshToken, _ := config.GenerateRefreshToken(user.ID, user.Email, user.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Email address changed",
+		"email":   u.Email,
+	})
+}
+
+// RevertEmailChange POST /api/email/change/revert
+func (h *Handler) RevertEmailChange(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if err := h.userService.RevertEmailChange(r.Context(), req.Token); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(TokenResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		ExpiresIn:    900,
-		UserID:       user.ID,
-		Username:     user.Username,
-		Email:        user.Email,
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Email address restored and all devices signed out, please reset your password",
 	})
 }
 
+// RequestMagicLink POST /api/login/magic-link
+func (h *Handler) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	h.userService.RequestMagicLink(req.Email)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If the email belongs to a verified account, a sign-in link has been sent",
+	})
+}
+
+// MagicLinkLogin POST /api/login/magic-link/verify
+func (h *Handler) MagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	var req MagicLinkLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	u, err := h.userService.LoginWithMagicLink(r.Context(), req.Token)
+	if err != nil {
+		writeLoginError(w, err)
+		return
+	}
+
+	h.completeLogin(w, r, u, req.DeviceName)
+}
+
 func (h *Handler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Email string `json:"email"`
@@ -114,7 +564,7 @@ func (h *Handler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.userService.RequestPasswordReset(req.Email)
+	h.userService.RequestPasswordReset(r.Context(), req.Email)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -134,10 +584,8 @@ func (h *Handler) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.userService.ResetPassword(req.Token, req.NewPassword); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	if err := h.userService.ResetPassword(r.Context(), req.Token, req.NewPassword); err != nil {
+		writeRequestError(w, err)
 		return
 	}
 
@@ -147,7 +595,186 @@ func (h *Handler) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// Logout POST /api/logout
 func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	var req LogoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	var err error
+	if req.AllDevices {
+		err = h.userService.RevokeAllSessions(r.Context(), claims.UserID)
+	} else {
+		err = h.userService.RevokeSession(r.Context(), claims.UserID, claims.SessionID)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to revoke session"})
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Logout successful"})
-}
\ No newline at end of file
+}
+
+// JWKS GET /.well-known/jwks.json
+func (h *Handler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(config.JWKS())
+}
+
+// completeLogin finishes a login whose first factor succeeded. Users with
+// two-factor authentication get a challenge token instead of a session.
+func (h *Handler) completeLogin(w http.ResponseWriter, r *http.Request, u *user.User, deviceName string) {
+	if !u.HasTOTP() {
+		h.startSession(w, r, http.StatusOK, u, deviceName)
+		return
+	}
+
+	mfaToken, err := config.GenerateMFAChallengeToken(config.CustomClaims{
+		UserID:   u.ID,
+		Email:    u.Email,
+		Username: u.Username,
+	})
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to issue mfa token"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFAChallengeResponse{
+		MFARequired: true,
+		MFAToken:    mfaToken,
+		ExpiresIn:   int(config.JWT.MFATokenDuration.Seconds()),
+	})
+}
+
+// startSession opens a new session for u and writes its token pair.
+func (h *Handler) startSession(w http.ResponseWriter, r *http.Request, status int, u *user.User, deviceName string) {
+	session, err := h.userService.CreateSession(u.ID, sessionInfo(r, deviceName))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create session"})
+		return
+	}
+
+	h.writeTokens(w, status, u, session)
+}
+
+// writeTokens signs an access token and a refresh token bound to session.
+func (h *Handler) writeTokens(w http.ResponseWriter, status int, u *user.User, session *user.Session) {
+	claims := config.CustomClaims{
+		UserID:        u.ID,
+		Email:         u.Email,
+		EmailVerified: u.IsEmailVerified(),
+		Username:      u.Username,
+		Role:          u.Role,
+		Permissions:   u.PermissionList(),
+		SessionID:     session.FamilyID,
+	}
+
+	accessToken, err := config.GenerateAccessToken(claims)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to issue tokens"})
+		return
+	}
+
+	refreshToken, err := config.GenerateRefreshToken(claims, session.Token)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to issue tokens"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken:   accessToken,
+		RefreshToken:  refreshToken,
+		ExpiresIn:     int(config.JWT.AccessTokenDuration.Seconds()),
+		UserID:        u.ID,
+		Username:      u.Username,
+		Email:         u.Email,
+		EmailVerified: u.IsEmailVerified(),
+		Role:          u.Role,
+	})
+}
+
+func sessionInfo(r *http.Request, deviceName string) user.SessionInfo {
+	return user.SessionInfo{
+		DeviceName: deviceName,
+		UserAgent:  r.UserAgent(),
+		IPAddress:  utils.ClientIP(r),
+	}
+}
+
+// writeRequestError reports a rejected request as a 400. A password that
+// breaks the password policy is reported with every violation.
+func writeRequestError(w http.ResponseWriter, err error) {
+	var policyErr *passwordpolicy.PolicyError
+	if errors.As(err, &policyErr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":      policyErr.Error(),
+			"code":       "password_policy",
+			"violations": policyErr.Violations,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// writeLoginError reports a failed login, adding the lockout code and retry
+// delay when further attempts are being refused.
+func writeLoginError(w http.ResponseWriter, err error) {
+	var blocked *user.LoginBlockedError
+	if errors.As(err, &blocked) {
+		retryAfter := int(math.Ceil(blocked.RetryAfter.Seconds()))
+		status := http.StatusTooManyRequests
+		if blocked.Code == "account_locked" {
+			status = http.StatusLocked
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":       blocked.Error(),
+			"code":        blocked.Code,
+			"retry_after": retryAfter,
+		})
+		return
+	}
+
+	if errors.Is(err, user.ErrPendingDeletion) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+			"code":  "pending_deletion",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,525 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete server configuration. Load builds it from the
+// defaults, an optional YAML file, the environment and command line flags,
+// each overriding the one before.
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Database  DatabaseConfig  `yaml:"database"`
+	JWT       TokenConfig     `yaml:"jwt"`
+	Email     EmailConfig     `yaml:"email"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Accounts  AccountsConfig  `yaml:"accounts"`
+	Password  PasswordConfig  `yaml:"password"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+
+	// OAuthProviders are the external identity providers users can sign in
+	// with, keyed by the name used in their routes.
+	OAuthProviders map[string]OAuthProviderConfig `yaml:"oauth_providers"`
+}
+
+type ServerConfig struct {
+	Port int `yaml:"port"`
+	// TrustedProxies are the CIDRs whose X-Forwarded-For header is honoured.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// The timeouts of http.Server. Takeout uploads and downloads extend
+	// their own deadlines.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests and background jobs
+	// get to finish after SIGTERM or SIGINT.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+type DatabaseConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password Secret `yaml:"password"`
+	Name     string `yaml:"name"`
+	// SSLMode is a libpq sslmode such as "require" or "verify-full".
+	SSLMode string `yaml:"sslmode"`
+	// AutoMigrate applies pending migrations when the server starts. When
+	// it is off the server refuses to start until "migrate up" has run.
+	AutoMigrate bool `yaml:"auto_migrate"`
+}
+
+// DSN returns the connection URL for the database.
+func (c DatabaseConfig) DSN() string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.User, string(c.Password)),
+		Host:     net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		Path:     "/" + c.Name,
+		RawQuery: url.Values{"sslmode": {c.SSLMode}}.Encode(),
+	}
+	return u.String()
+}
+
+// TokenConfig selects the keys JWTs are signed and verified with, see InitJWT.
+type TokenConfig struct {
+	SecretKey   Secret   `yaml:"secret_key"`
+	KeyFiles    []string `yaml:"key_files"`
+	ActiveKeyID string   `yaml:"active_key_id"`
+}
+
+type EmailConfig struct {
+	ResendAPIKey Secret `yaml:"resend_api_key"`
+	Sender       string `yaml:"sender"`
+}
+
+type StorageConfig struct {
+	UploadDir  string `yaml:"upload_dir"`
+	TakeoutDir string `yaml:"takeout_dir"`
+}
+
+type AccountsConfig struct {
+	// DeletionGracePeriod is how long a deleted account can be restored
+	// before it is purged.
+	DeletionGracePeriod time.Duration `yaml:"deletion_grace_period"`
+}
+
+type PasswordConfig struct {
+	MinLength int `yaml:"min_length"`
+	// MinStrength is the lowest accepted strength score from 0 to 4.
+	MinStrength       int    `yaml:"min_strength"`
+	BreachedHashesDir string `yaml:"breached_hashes_dir"`
+}
+
+type RateLimitConfig struct {
+	// Store is "memory" for a single instance or "postgres" to share the
+	// limits between instances.
+	Store string `yaml:"store"`
+}
+
+// OAuthProviderConfig describes an OAuth2 or OpenID Connect provider. OIDC
+// providers only need Issuer; the endpoints are discovered from it.
+type OAuthProviderConfig struct {
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret Secret   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"`
+	Issuer       string   `yaml:"issuer"`
+	AuthURL      string   `yaml:"auth_url"`
+	TokenURL     string   `yaml:"token_url"`
+	UserInfoURL  string   `yaml:"userinfo_url"`
+	Scopes       []string `yaml:"scopes"`
+
+	// Claim names read from the userinfo response
+	SubjectField       string `yaml:"subject_field"`
+	EmailField         string `yaml:"email_field"`
+	EmailVerifiedField string `yaml:"email_verified_field"`
+	UsernameField      string `yaml:"username_field"`
+}
+
+// Secret is a configuration value that must not show up in logs.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// MarshalYAML keeps secrets out of the dump returned by Config.String.
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+// Default returns the configuration used for anything left unset.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:              5000,
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       time.Minute,
+			WriteTimeout:      2 * time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Database: DatabaseConfig{
+			Host:        "localhost",
+			Port:        5432,
+			SSLMode:     "prefer",
+			AutoMigrate: true,
+		},
+		Email: EmailConfig{
+			Sender: "noreply@rideaware.app",
+		},
+		Storage: StorageConfig{
+			UploadDir:  "uploads",
+			TakeoutDir: "exports",
+		},
+		Accounts: AccountsConfig{
+			DeletionGracePeriod: 30 * 24 * time.Hour,
+		},
+		Password: PasswordConfig{
+			MinLength:   8,
+			MinStrength: 2,
+		},
+		RateLimit: RateLimitConfig{
+			Store: "memory",
+		},
+	}
+}
+
+// Load builds the configuration and validates it. The flags it understands
+// are registered on fs before args are parsed, so commands can add their own
+// flags to fs first. The YAML file is named by -config or CONFIG_FILE.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	return load(fs, args, (*Config).Validate)
+}
+
+// LoadDatabase is Load for commands that only use the database, such as
+// migrate: the other sections are loaded but not validated.
+func LoadDatabase(fs *flag.FlagSet, args []string) (*Config, error) {
+	return load(fs, args, (*Config).ValidateDatabase)
+}
+
+func load(fs *flag.FlagSet, args []string, validate func(*Config) error) (*Config, error) {
+	var (
+		file       = fs.String("config", "", "path of a YAML configuration file")
+		port       = fs.Int("port", 0, "port to listen on")
+		uploadDir  = fs.String("upload-dir", "", "directory for uploaded workout files")
+		takeoutDir = fs.String("takeout-dir", "", "directory for takeout archives")
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+
+	path := *file
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Server.Port = *port
+		case "upload-dir":
+			cfg.Storage.UploadDir = *uploadDir
+		case "takeout-dir":
+			cfg.Storage.TakeoutDir = *takeoutDir
+		}
+	})
+
+	if err := validate(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv applies the environment variables that are set. The names predate
+// the config file and are kept so existing deployments keep working.
+func (c *Config) loadEnv() error {
+	env := envReader{}
+
+	env.number("PORT", &c.Server.Port)
+	env.list("TRUSTED_PROXIES", &c.Server.TrustedProxies)
+	env.duration("SERVER_READ_HEADER_TIMEOUT", &c.Server.ReadHeaderTimeout)
+	env.duration("SERVER_READ_TIMEOUT", &c.Server.ReadTimeout)
+	env.duration("SERVER_WRITE_TIMEOUT", &c.Server.WriteTimeout)
+	env.duration("SERVER_IDLE_TIMEOUT", &c.Server.IdleTimeout)
+	env.duration("SERVER_SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout)
+
+	env.text("PG_HOST", &c.Database.Host)
+	env.number("PG_PORT", &c.Database.Port)
+	env.text("PG_USER", &c.Database.User)
+	env.secret("PG_PASSWORD", &c.Database.Password)
+	env.text("PG_DATABASE", &c.Database.Name)
+	env.text("PG_SSLMODE", &c.Database.SSLMode)
+	env.boolean("PG_AUTO_MIGRATE", &c.Database.AutoMigrate)
+
+	env.secret("JWT_SECRET_KEY", &c.JWT.SecretKey)
+	env.list("JWT_KEY_FILES", &c.JWT.KeyFiles)
+	env.text("JWT_ACTIVE_KEY_ID", &c.JWT.ActiveKeyID)
+
+	env.secret("RESEND_API_KEY", &c.Email.ResendAPIKey)
+	env.text("SENDER_EMAIL", &c.Email.Sender)
+
+	env.text("UPLOAD_DIR", &c.Storage.UploadDir)
+	env.text("TAKEOUT_DIR", &c.Storage.TakeoutDir)
+
+	env.duration("ACCOUNT_DELETION_GRACE_PERIOD", &c.Accounts.DeletionGracePeriod)
+
+	env.number("PASSWORD_MIN_LENGTH", &c.Password.MinLength)
+	env.number("PASSWORD_MIN_STRENGTH", &c.Password.MinStrength)
+	env.text("PASSWORD_BREACHED_HASHES_DIR", &c.Password.BreachedHashesDir)
+
+	env.text("RATE_LIMIT_STORE", &c.RateLimit.Store)
+
+	// OAUTH_PROVIDERS names the providers; a provider called "google" is
+	// configured by the OAUTH_GOOGLE_* variables.
+	var names []string
+	env.list("OAUTH_PROVIDERS", &names)
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if c.OAuthProviders == nil {
+			c.OAuthProviders = map[string]OAuthProviderConfig{}
+		}
+		p := c.OAuthProviders[name]
+		prefix := "OAUTH_" + strings.ToUpper(name) + "_"
+		env.text(prefix+"CLIENT_ID", &p.ClientID)
+		env.secret(prefix+"CLIENT_SECRET", &p.ClientSecret)
+		env.text(prefix+"REDIRECT_URL", &p.RedirectURL)
+		env.text(prefix+"ISSUER", &p.Issuer)
+		env.text(prefix+"AUTH_URL", &p.AuthURL)
+		env.text(prefix+"TOKEN_URL", &p.TokenURL)
+		env.text(prefix+"USERINFO_URL", &p.UserInfoURL)
+		env.fields(prefix+"SCOPES", &p.Scopes)
+		env.text(prefix+"SUBJECT_FIELD", &p.SubjectField)
+		env.text(prefix+"EMAIL_FIELD", &p.EmailField)
+		env.text(prefix+"EMAIL_VERIFIED_FIELD", &p.EmailVerifiedField)
+		env.text(prefix+"USERNAME_FIELD", &p.UsernameField)
+		c.OAuthProviders[name] = p
+	}
+
+	return env.err()
+}
+
+// Validate checks the whole configuration and reports every problem at once.
+// It also fills in the defaults of OAuth providers.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port (PORT) must be between 1 and 65535")
+	for _, cidr := range c.Server.TrustedProxies {
+		_, _, err := net.ParseCIDR(cidr)
+		check(err == nil, "server.trusted_proxies (TRUSTED_PROXIES): %q is not a CIDR", cidr)
+	}
+	check(c.Server.ReadHeaderTimeout > 0, "server.read_header_timeout (SERVER_READ_HEADER_TIMEOUT) must be positive")
+	check(c.Server.ReadTimeout > 0, "server.read_timeout (SERVER_READ_TIMEOUT) must be positive")
+	check(c.Server.WriteTimeout > 0, "server.write_timeout (SERVER_WRITE_TIMEOUT) must be positive")
+	check(c.Server.IdleTimeout > 0, "server.idle_timeout (SERVER_IDLE_TIMEOUT) must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout (SERVER_SHUTDOWN_TIMEOUT) must be positive")
+
+	problems = append(problems, c.Database.problems()...)
+
+	check(c.JWT.SecretKey != "" || len(c.JWT.KeyFiles) > 0,
+		"jwt.key_files (JWT_KEY_FILES) or jwt.secret_key (JWT_SECRET_KEY) is required")
+	check(c.JWT.ActiveKeyID == "" || len(c.JWT.KeyFiles) > 0,
+		"jwt.active_key_id (JWT_ACTIVE_KEY_ID) needs jwt.key_files (JWT_KEY_FILES)")
+
+	check(c.Email.ResendAPIKey != "", "email.resend_api_key (RESEND_API_KEY) is required")
+	_, err := mail.ParseAddress(c.Email.Sender)
+	check(err == nil, "email.sender (SENDER_EMAIL) %q is not an email address", c.Email.Sender)
+
+	check(c.Storage.UploadDir != "", "storage.upload_dir (UPLOAD_DIR) must not be empty")
+	check(c.Storage.TakeoutDir != "", "storage.takeout_dir (TAKEOUT_DIR) must not be empty")
+
+	check(c.Accounts.DeletionGracePeriod >= 0,
+		"accounts.deletion_grace_period (ACCOUNT_DELETION_GRACE_PERIOD) must not be negative")
+
+	check(c.Password.MinLength >= 1 && c.Password.MinLength <= 128,
+		"password.min_length (PASSWORD_MIN_LENGTH) must be between 1 and 128")
+	check(c.Password.MinStrength >= 0 && c.Password.MinStrength <= 4,
+		"password.min_strength (PASSWORD_MIN_STRENGTH) must be between 0 and 4")
+	if dir := c.Password.BreachedHashesDir; dir != "" {
+		info, err := os.Stat(dir)
+		check(err == nil && info.IsDir(),
+			"password.breached_hashes_dir (PASSWORD_BREACHED_HASHES_DIR) %q is not a directory", dir)
+	}
+
+	check(c.RateLimit.Store == "memory" || c.RateLimit.Store == "postgres",
+		"rate_limit.store (RATE_LIMIT_STORE) must be memory or postgres")
+
+	for name, p := range c.OAuthProviders {
+		where := "oauth_providers." + name
+		check(p.ClientID != "", "%s.client_id is required", where)
+		check(p.RedirectURL != "", "%s.redirect_url is required", where)
+		check(p.Issuer != "" || (p.AuthURL != "" && p.TokenURL != "" && p.UserInfoURL != ""),
+			"%s: set issuer or all of auth_url, token_url and userinfo_url", where)
+		c.OAuthProviders[name] = p.withDefaults()
+	}
+
+	return invalid(problems)
+}
+
+// ValidateDatabase checks only the database section, for commands that
+// need nothing else.
+func (c *Config) ValidateDatabase() error {
+	return invalid(c.Database.problems())
+}
+
+func (c DatabaseConfig) problems() []string {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Host != "", "database.host (PG_HOST) is required")
+	check(c.Port > 0 && c.Port < 65536, "database.port (PG_PORT) must be between 1 and 65535")
+	check(c.User != "", "database.user (PG_USER) is required")
+	check(c.Name != "", "database.name (PG_DATABASE) is required")
+	switch c.SSLMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		check(false, "database.sslmode (PG_SSLMODE) %q is not a valid sslmode", c.SSLMode)
+	}
+	return problems
+}
+
+func invalid(problems []string) error {
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func (p OAuthProviderConfig) withDefaults() OAuthProviderConfig {
+	p.Issuer = strings.TrimSuffix(p.Issuer, "/")
+	if len(p.Scopes) == 0 && p.Issuer != "" {
+		p.Scopes = []string{"openid", "email", "profile"}
+	}
+	if p.SubjectField == "" {
+		p.SubjectField = "sub"
+	}
+	if p.EmailField == "" {
+		p.EmailField = "email"
+	}
+	if p.EmailVerifiedField == "" {
+		p.EmailVerifiedField = "email_verified"
+	}
+	if p.UsernameField == "" {
+		p.UsernameField = "preferred_username"
+	}
+	return p
+}
+
+// String dumps the configuration as YAML with secrets redacted, for logging.
+func (c *Config) String() string {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// envReader copies set environment variables into the config, remembering
+// values that fail to parse.
+type envReader struct {
+	problems []string
+}
+
+func (e *envReader) text(key string, dst *string) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		*dst = value
+	}
+}
+
+func (e *envReader) secret(key string, dst *Secret) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		*dst = Secret(value)
+	}
+}
+
+func (e *envReader) number(key string, dst *int) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			e.problems = append(e.problems, fmt.Sprintf("%s %q is not a number", key, value))
+			return
+		}
+		*dst = n
+	}
+}
+
+func (e *envReader) boolean(key string, dst *bool) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			e.problems = append(e.problems, fmt.Sprintf("%s %q is not true or false", key, value))
+			return
+		}
+		*dst = b
+	}
+}
+
+func (e *envReader) duration(key string, dst *time.Duration) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			e.problems = append(e.problems, fmt.Sprintf("%s %q is not a duration such as 720h", key, value))
+			return
+		}
+		*dst = d
+	}
+}
+
+// list reads a comma separated list.
+func (e *envReader) list(key string, dst *[]string) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*dst = items
+	}
+}
+
+// fields reads a list separated by commas or spaces.
+func (e *envReader) fields(key string, dst *[]string) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		*dst = strings.Fields(strings.ReplaceAll(value, ",", " "))
+	}
+}
+
+func (e *envReader) err() error {
+	if len(e.problems) > 0 {
+		return errors.New("invalid environment:\n  " + strings.Join(e.problems, "\n  "))
+	}
+	return nil
+}
@@ -2,74 +2,145 @@ package config
 
 import (
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type JWTConfig struct {
-	SecretKey             string
+	// SecretKey is the legacy HS256 secret. It signs tokens only when no
+	// asymmetric key is configured, otherwise it just keeps HS256 tokens
+	// issued before the switch valid until they expire.
+	SecretKey            string
 	AccessTokenDuration  time.Duration
 	RefreshTokenDuration time.Duration
 	ResetTokenDuration   time.Duration
+	MagicLinkDuration    time.Duration
+	MFATokenDuration     time.Duration
+
+	// ImpersonationDuration is how long a support impersonation token lasts.
+	// It cannot be refreshed.
+	ImpersonationDuration time.Duration
+
+	// Keys are all asymmetric keys accepted for verification and published
+	// in the JWKS. ActiveKey is the one new tokens are signed with.
+	Keys      []*SigningKey
+	ActiveKey *SigningKey
 }
 
 var JWT *JWTConfig
 
-func InitJWT() {
+// InitJWT loads the signing keys listed in cfg.KeyFiles. The key named by
+// cfg.ActiveKeyID (or the first one) signs new tokens while the others are
+// kept for verification, which lets a new key be published before it is used
+// and an old one stay valid until its tokens expire.
+func InitJWT(cfg TokenConfig) error {
 	JWT = &JWTConfig{
-		SecretKey:            os.Getenv("JWT_SECRET_KEY"),
+		SecretKey:            string(cfg.SecretKey),
 		AccessTokenDuration:  15 * time.Minute,
 		RefreshTokenDuration: 7 * 24 * time.Hour,
 		ResetTokenDuration:   1 * time.Hour,
+		MagicLinkDuration:    15 * time.Minute,
+		MFATokenDuration:     5 * time.Minute,
+
+		ImpersonationDuration: 30 * time.Minute,
+	}
+
+	keys, err := loadSigningKeys(cfg.KeyFiles)
+	if err != nil {
+		return fmt.Errorf("failed to load JWT keys: %w", err)
+	}
+	JWT.Keys = keys
+
+	activeID := cfg.ActiveKeyID
+	for _, key := range keys {
+		if !key.CanSign() {
+			continue
+		}
+		if activeID == "" || key.ID == activeID {
+			JWT.ActiveKey = key
+			break
+		}
+	}
+
+	if activeID != "" && JWT.ActiveKey == nil {
+		return fmt.Errorf("active JWT key %q is not a private key in the key files", activeID)
 	}
 
-	if JWT.SecretKey == "" {
-		panic("JWT_SECRET_KEY not set in environment")
+	if JWT.ActiveKey == nil && JWT.SecretKey == "" {
+		return fmt.Errorf("no private JWT key or JWT secret configured")
 	}
+	return nil
 }
 
 type CustomClaims struct {
-	UserID    uint   `json:"user_id"`
-	Email     string `json:"email"`
-	Username  string `json:"username"`
-	TokenType string `json:"token_type"`
+	UserID        uint     `json:"user_id"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Username      string   `json:"username"`
+	Role          string   `json:"role,omitempty"`
+	Permissions   []string `json:"permissions,omitempty"`
+	TokenType     string   `json:"token_type"`
+	SessionID     string   `json:"sid,omitempty"`       // user.Session family the token belongs to
+	Scopes        []string `json:"scopes,omitempty"`    // nil for first-party sessions, which are unrestricted
+	ClientID      string   `json:"client_id,omitempty"` // OAuth2 client the token was issued to
+
+	// ImpersonatorID is the admin acting as UserID on an impersonation token
+	ImpersonatorID uint `json:"impersonator_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func GenerateAccessToken(userID uint, email, username string) (string, error) {
-	claims := CustomClaims{
-		UserID:    userID,
-		Email:     email,
-		Username:  username,
-		TokenType: "access",
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(JWT.AccessTokenDuration)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			Issuer:    "rideaware",
-		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(JWT.SecretKey))
+// GenerateAccessToken signs an access token for the identity in claims.
+func GenerateAccessToken(claims CustomClaims) (string, error) {
+	claims.TokenType = "access"
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(JWT.AccessTokenDuration)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		Issuer:    "rideaware",
+	}
+
+	return signToken(claims)
+}
+
+// GenerateRefreshToken signs a refresh token whose jti is the token recorded
+// on the matching user.Session row.
+func GenerateRefreshToken(claims CustomClaims, tokenID string) (string, error) {
+	claims.TokenType = "refresh"
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ID:        tokenID,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(JWT.RefreshTokenDuration)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		Issuer:    "rideaware",
+	}
+
+	return signToken(claims)
+}
+
+// GenerateImpersonationToken signs a short-lived access token that lets
+// claims.ImpersonatorID act as claims.UserID. There is no refresh token; the
+// admin mints a new one when it expires.
+func GenerateImpersonationToken(claims CustomClaims) (string, error) {
+	claims.TokenType = "access"
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(JWT.ImpersonationDuration)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		Issuer:    "rideaware",
+	}
+
+	return signToken(claims)
 }
 
-func GenerateRefreshToken(userID uint, email, username string) (string, error) {
-	claims := CustomClaims{
-		UserID:    userID,
-		Email:     email,
-		Username:  username,
-		TokenType: "refresh",
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(JWT.RefreshTokenDuration)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			Issuer:    "rideaware",
-		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(JWT.SecretKey))
+// GenerateMFAChallengeToken signs the short-lived token a login that still
+// needs its second factor is exchanged for.
+func GenerateMFAChallengeToken(claims CustomClaims) (string, error) {
+	claims.TokenType = "mfa_challenge"
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(JWT.MFATokenDuration)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		Issuer:    "rideaware",
+	}
+
+	return signToken(claims)
 }
 
 func VerifyToken(tokenString string) (*CustomClaims, error) {
@@ -77,12 +148,8 @@ func VerifyToken(tokenString string) (*CustomClaims, error) {
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		claims,
-		func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(JWT.SecretKey), nil
-		},
+		verificationKey,
+		jwt.WithValidMethods(validMethods()),
 	)
 
 	if err != nil {
@@ -94,4 +161,51 @@ func VerifyToken(tokenString string) (*CustomClaims, error) {
 	}
 
 	return claims, nil
-}
\ No newline at end of file
+}
+
+func signToken(claims CustomClaims) (string, error) {
+	if JWT.ActiveKey == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString([]byte(JWT.SecretKey))
+	}
+
+	token := jwt.NewWithClaims(JWT.ActiveKey.Method, claims)
+	token.Header["kid"] = JWT.ActiveKey.ID
+	return token.SignedString(JWT.ActiveKey.PrivateKey)
+}
+
+// verificationKey resolves the key for a token from its kid. HMAC tokens are
+// only checked against the legacy secret so a public key can never be
+// mistaken for an HMAC secret.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if JWT.SecretKey == "" {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(JWT.SecretKey), nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	for _, key := range JWT.Keys {
+		if key.ID != kid {
+			continue
+		}
+		if key.Method.Alg() != token.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.PublicKey, nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func validMethods() []string {
+	var methods []string
+	if JWT.SecretKey != "" {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	for _, key := range JWT.Keys {
+		methods = append(methods, key.Method.Alg())
+	}
+	return methods
+}
@@ -2,33 +2,40 @@ package email
 
 import (
 	"fmt"
-	"os"
+	"html"
+	"net/http"
+	"time"
 
 	"github.com/resend/resend-go/v2"
+
+	"rideaware/internal/config"
 )
 
+// sendTimeout bounds a call to Resend, so a slow API can't hold up the
+// request that sends the email or a shutdown.
+const sendTimeout = 15 * time.Second
+
 type Service struct {
 	client *resend.Client
+	http   *http.Client
 	from   string
 }
 
-func NewService() *Service {
-	senderEmail := os.Getenv("SENDER_EMAIL")
-	if senderEmail == "" {
-		senderEmail = "noreply@rideaware.app"
-	}
-
-	apiKey := os.Getenv("RESEND_API_KEY")
-	if apiKey == "" {
-		apiKey = "re_test"
-	}
-
+func NewService(cfg config.EmailConfig) *Service {
+	httpClient := &http.Client{Timeout: sendTimeout}
 	return &Service{
-		client: resend.NewClient(apiKey),
-		from:   senderEmail,
+		client: resend.NewCustomClient(httpClient, string(cfg.ResendAPIKey)),
+		http:   httpClient,
+		from:   cfg.Sender,
 	}
 }
 
+// Close drops the idle connections to Resend. Nothing may send email after
+// it is called.
+func (s *Service) Close() {
+	s.http.CloseIdleConnections()
+}
+
 func (s *Service) SendPasswordResetEmail(email, username, resetLink string) error {
 	params := &resend.SendEmailRequest{
 		From:    s.from,
@@ -56,6 +63,60 @@ func (s *Service) SendPasswordResetEmail(email, username, resetLink string) erro
 	return nil
 }
 
+func (s *Service) SendMagicLinkEmail(email, username, loginLink string, validFor time.Duration) error {
+	params := &resend.SendEmailRequest{
+		From:    s.from,
+		To:      []string{email},
+		Subject: "Your RideAware Sign-in Link",
+		Html: fmt.Sprintf(`
+			<h2>Sign In to RideAware</h2>
+			<p>Hi %s,</p>
+			<p>Click the link below to sign in. It can be used once:</p>
+			<p><a href="%s">Sign In</a></p>
+			<p>This link will expire in %d minutes.</p>
+			<p>If you didn't request this, you can ignore this email.</p>
+		`, username, loginLink, int(validFor.Minutes())),
+	}
+
+	sent, err := s.client.Emails.Send(params)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	if sent.Id == "" {
+		return fmt.Errorf("failed to send email")
+	}
+
+	return nil
+}
+
+func (s *Service) SendVerificationEmail(email, username, verifyLink string) error {
+	params := &resend.SendEmailRequest{
+		From:    s.from,
+		To:      []string{email},
+		Subject: "Verify Your RideAware Email Address",
+		Html: fmt.Sprintf(`
+			<h2>Confirm Your Email</h2>
+			<p>Hi %s,</p>
+			<p>Thanks for signing up for RideAware! Please confirm this is your email address:</p>
+			<p><a href="%s">Verify Email</a></p>
+			<p>This link will expire in 24 hours.</p>
+			<p>If you didn't create an account, you can ignore this email.</p>
+		`, username, verifyLink),
+	}
+
+	sent, err := s.client.Emails.Send(params)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	if sent.Id == "" {
+		return fmt.Errorf("failed to send email")
+	}
+
+	return nil
+}
+
 func (s *Service) SendWelcomeEmail(email, username string) error {
 	params := &resend.SendEmailRequest{
 		From:    s.from,
@@ -79,4 +140,189 @@ func (s *Service) SendWelcomeEmail(email, username string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+func (s *Service) SendAccountLockedEmail(email, username, unlockLink string, until time.Time) error {
+	params := &resend.SendEmailRequest{
+		From:    s.from,
+		To:      []string{email},
+		Subject: "Your RideAware Account Has Been Locked",
+		Html: fmt.Sprintf(`
+			<h2>Account Temporarily Locked</h2>
+			<p>Hi %s,</p>
+			<p>We locked your account after too many failed sign-in attempts. It will unlock automatically at %s.</p>
+			<p>If these attempts were yours, you can unlock it right away:</p>
+			<p><a href="%s">Unlock Account</a></p>
+			<p>If they weren't, consider resetting your password.</p>
+		`, username, until.UTC().Format("15:04 MST"), unlockLink),
+	}
+
+	sent, err := s.client.Emails.Send(params)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	if sent.Id == "" {
+		return fmt.Errorf("failed to send email")
+	}
+
+	return nil
+}
+
+func (s *Service) SendDeletionScheduledEmail(email, username, undoLink string, purgeAt time.Time) error {
+	params := &resend.SendEmailRequest{
+		From:    s.from,
+		To:      []string{email},
+		Subject: "Your RideAware Account Will Be Deleted",
+		Html: fmt.Sprintf(`
+			<h2>Account Deletion Scheduled</h2>
+			<p>Hi %s,</p>
+			<p>Your account and all of its data will be permanently deleted on %s.</p>
+			<p>Changed your mind? You can restore your account until then:</p>
+			<p><a href="%s">Restore Account</a></p>
+			<p>If you didn't request this, restore your account and reset your password.</p>
+		`, username, purgeAt.UTC().Format("January 2, 2006"), undoLink),
+	}
+
+	sent, err := s.client.Emails.Send(params)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	if sent.Id == "" {
+		return fmt.Errorf("failed to send email")
+	}
+
+	return nil
+}
+
+func (s *Service) SendAccountDeletedEmail(email, username string) error {
+	params := &resend.SendEmailRequest{
+		From:    s.from,
+		To:      []string{email},
+		Subject: "Your RideAware Account Has Been Deleted",
+		Html: fmt.Sprintf(`
+			<h2>Account Deleted</h2>
+			<p>Hi %s,</p>
+			<p>Your RideAware account and all of its data have been permanently deleted.</p>
+			<p>Thanks for riding with us.</p>
+		`, username),
+	}
+
+	sent, err := s.client.Emails.Send(params)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	if sent.Id == "" {
+		return fmt.Errorf("failed to send email")
+	}
+
+	return nil
+}
+
+func (s *Service) SendTakeoutReadyEmail(email, username, downloadLink string, expiresAt time.Time) error {
+	params := &resend.SendEmailRequest{
+		From:    s.from,
+		To:      []string{email},
+		Subject: "Your RideAware Data Export Is Ready",
+		Html: fmt.Sprintf(`
+			<h2>Your Data Export Is Ready</h2>
+			<p>Hi %s,</p>
+			<p>The archive of your RideAware data you requested is ready to download:</p>
+			<p><a href="%s">Download Archive</a></p>
+			<p>This link will expire on %s.</p>
+			<p>If you didn't request this export, reset your password.</p>
+		`, username, downloadLink, expiresAt.UTC().Format("January 2, 2006")),
+	}
+
+	sent, err := s.client.Emails.Send(params)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	if sent.Id == "" {
+		return fmt.Errorf("failed to send email")
+	}
+
+	return nil
+}
+
+func (s *Service) SendPasswordChangedEmail(email, username string) error {
+	params := &resend.SendEmailRequest{
+		From:    s.from,
+		To:      []string{email},
+		Subject: "Your RideAware Password Was Changed",
+		Html: fmt.Sprintf(`
+			<h2>Password Changed</h2>
+			<p>Hi %s,</p>
+			<p>The password of your RideAware account was just changed and your other devices were signed out.</p>
+			<p>If you didn't do this, reset your password right away.</p>
+		`, username),
+	}
+
+	sent, err := s.client.Emails.Send(params)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	if sent.Id == "" {
+		return fmt.Errorf("failed to send email")
+	}
+
+	return nil
+}
+
+func (s *Service) SendEmailChangeConfirmationEmail(email, username, confirmLink string) error {
+	params := &resend.SendEmailRequest{
+		From:    s.from,
+		To:      []string{email},
+		Subject: "Confirm Your New RideAware Email Address",
+		Html: fmt.Sprintf(`
+			<h2>Confirm Your New Email</h2>
+			<p>Hi %s,</p>
+			<p>Please confirm you want to use this address for your RideAware account:</p>
+			<p><a href="%s">Confirm Email</a></p>
+			<p>This link will expire in 24 hours.</p>
+			<p>If you didn't request this, you can ignore this email.</p>
+		`, username, confirmLink),
+	}
+
+	sent, err := s.client.Emails.Send(params)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	if sent.Id == "" {
+		return fmt.Errorf("failed to send email")
+	}
+
+	return nil
+}
+
+func (s *Service) SendEmailChangedEmail(email, username, newEmail, revertLink string) error {
+	params := &resend.SendEmailRequest{
+		From:    s.from,
+		To:      []string{email},
+		Subject: "Your RideAware Email Address Was Changed",
+		Html: fmt.Sprintf(`
+			<h2>Email Address Changed</h2>
+			<p>Hi %s,</p>
+			<p>The email address of your RideAware account was changed to %s.</p>
+			<p>If you didn't do this, undo the change and sign out all devices:</p>
+			<p><a href="%s">This Wasn't Me</a></p>
+			<p>This link will expire in 7 days. Reset your password afterwards.</p>
+		`, username, html.EscapeString(newEmail), revertLink),
+	}
+
+	sent, err := s.client.Emails.Send(params)
+	if err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	if sent.Id == "" {
+		return fmt.Errorf("failed to send email")
+	}
+
+	return nil
+}
@@ -7,14 +7,46 @@ import (
 	"strings"
 
 	"rideaware/internal/config"
+	"rideaware/internal/rbac"
+	"rideaware/internal/scope"
 )
 
 const UserContextKey = "user"
 
-type AuthMiddleware struct{}
+// SessionValidator reports whether the session an access token was issued
+// for is still active and belongs to userID.
+type SessionValidator interface {
+	IsSessionActive(userID uint, sessionID string) bool
+}
+
+// ImpersonationAuditor records every request made with an impersonation
+// token in the audit trail of the impersonated user.
+type ImpersonationAuditor interface {
+	RecordImpersonatedRequest(ctx context.Context, impersonatorID, userID uint, request string)
+}
+
+// PersonalAccessTokenPrefix starts every personal access token, which is how
+// they are told apart from JWTs in the Authorization header.
+const PersonalAccessTokenPrefix = "rwpat_"
+
+// TokenAuthenticator resolves a personal access token to the claims of its
+// owner, restricted to the token's scopes.
+type TokenAuthenticator interface {
+	AuthenticateToken(token string) (*config.CustomClaims, error)
+}
+
+type AuthMiddleware struct {
+	sessions SessionValidator
+	tokens   TokenAuthenticator
+	auditor  ImpersonationAuditor
+}
 
-func NewAuthMiddleware() *AuthMiddleware {
-	return &AuthMiddleware{}
+func NewAuthMiddleware(sessions SessionValidator, tokens TokenAuthenticator, auditor ImpersonationAuditor) *AuthMiddleware {
+	return &AuthMiddleware{
+		sessions: sessions,
+		tokens:   tokens,
+		auditor:  auditor,
+	}
 }
 
 func (am *AuthMiddleware) ProtectedRoute(next http.Handler) http.Handler {
@@ -40,6 +72,22 @@ func (am *AuthMiddleware) ProtectedRoute(next http.Handler) http.Handler {
 		}
 
 		token := parts[1]
+		if strings.HasPrefix(token, PersonalAccessTokenPrefix) {
+			claims, err := am.tokens.AuthenticateToken(token)
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error": "invalid or expired token",
+				})
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), UserContextKey, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		claims, err := config.VerifyToken(token)
 		if err != nil {
 			w.Header().Set("Content-Type", "application/json")
@@ -59,7 +107,157 @@ func (am *AuthMiddleware) ProtectedRoute(next http.Handler) http.Handler {
 			return
 		}
 
+		// An impersonation token shares the admin's session
+		sessionOwner := claims.UserID
+		if claims.ImpersonatorID != 0 {
+			sessionOwner = claims.ImpersonatorID
+		}
+		if !am.sessions.IsSessionActive(sessionOwner, claims.SessionID) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "session has expired or been revoked",
+			})
+			return
+		}
+
+		if claims.ImpersonatorID != 0 {
+			am.auditor.RecordImpersonatedRequest(r.Context(), claims.ImpersonatorID, claims.UserID, r.Method+" "+r.URL.Path)
+		}
+
 		ctx := context.WithValue(r.Context(), UserContextKey, claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
-}
\ No newline at end of file
+}
+
+// RequireVerifiedEmail restricts a route to users who confirmed their email
+// address. It must run after ProtectedRoute.
+func (am *AuthMiddleware) RequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(UserContextKey).(*config.CustomClaims)
+		if !ok || !claims.EmailVerified {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "email address not verified",
+				"code":  "email_unverified",
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope restricts a route to credentials granted scope s. Tokens from
+// a first-party login carry no scopes and are not restricted. It must run
+// after ProtectedRoute.
+func (am *AuthMiddleware) RequireScope(s string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(UserContextKey).(*config.CustomClaims)
+			if !ok || (claims.Scopes != nil && !scope.Contains(claims.Scopes, s)) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error": "token is missing the " + s + " scope",
+					"code":  "insufficient_scope",
+				})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSession restricts a route to a first-party login, keeping account
+// and credential management out of reach of delegated tokens. It must run
+// after ProtectedRoute.
+func (am *AuthMiddleware) RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(UserContextKey).(*config.CustomClaims)
+		if !ok || claims.TokenType != "access" || claims.Scopes != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "this endpoint requires a signed-in session",
+				"code":  "session_required",
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DenyImpersonation keeps support staff acting as a user away from the
+// user's credentials and security settings. It must run after ProtectedRoute.
+func (am *AuthMiddleware) DenyImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(UserContextKey).(*config.CustomClaims)
+		if !ok || claims.ImpersonatorID != 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "not available while impersonating a user",
+				"code":  "impersonation_forbidden",
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireRole restricts a route to users holding one of roles. It must run
+// after ProtectedRoute.
+func (am *AuthMiddleware) RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(UserContextKey).(*config.CustomClaims)
+			allowed := false
+			if ok {
+				for _, role := range roles {
+					if claims.Role == role {
+						allowed = true
+						break
+					}
+				}
+			}
+
+			if !allowed {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error": "your role does not allow this action",
+					"code":  "forbidden",
+				})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequirePermission restricts a route to users granted permission p, either
+// through their role or individually. It must run after ProtectedRoute.
+func (am *AuthMiddleware) RequirePermission(p string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(UserContextKey).(*config.CustomClaims)
+			if !ok || !rbac.Has(claims.Permissions, p) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error": "missing the " + p + " permission",
+					"code":  "forbidden",
+				})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
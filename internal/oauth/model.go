@@ -0,0 +1,40 @@
+package oauth
+
+import "time"
+
+// LoginState keeps the per-attempt secrets of an authorization request until
+// the provider redirects back: the state itself, the OIDC nonce and the PKCE
+// code verifier. SecretHash is the hash of the state secret given to the
+// client that started the flow, which must present it again to complete it.
+// UserID is set when a signed-in user is linking a provider.
+type LoginState struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	State        string    `gorm:"uniqueIndex;not null" json:"-"`
+	Provider     string    `gorm:"not null" json:"provider"`
+	Nonce        string    `gorm:"not null" json:"-"`
+	CodeVerifier string    `gorm:"not null" json:"-"`
+	SecretHash   string    `gorm:"not null" json:"-"`
+	UserID       *uint     `gorm:"index" json:"user_id"`
+	ExpiresAt    time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (LoginState) TableName() string {
+	return "oauth_login_states"
+}
+
+// UserInfo is the identity a provider vouched for.
+type UserInfo struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+}
+
+// Result is the outcome of a completed authorization. LinkUserID is set when
+// the flow was started to link the provider to an existing account.
+type Result struct {
+	UserInfo   UserInfo
+	LinkUserID *uint
+}
@@ -0,0 +1,56 @@
+package oauth
+
+import "rideaware/internal/config"
+
+// Provider is an OAuth2 identity provider configured by the operator.
+// Setting Issuer enables OpenID Connect: endpoints are discovered from the
+// issuer and the ID token is verified. Plain OAuth2 providers set the
+// endpoints directly and identify users through their userinfo endpoint.
+type Provider struct {
+	Name         string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Issuer       string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	Scopes       []string
+
+	// Userinfo fields holding the subject, email, email verification flag
+	// and preferred username.
+	SubjectField       string
+	EmailField         string
+	EmailVerifiedField string
+	UsernameField      string
+}
+
+// IsOIDC reports whether the provider is an OpenID Connect issuer.
+func (p *Provider) IsOIDC() bool {
+	return p.Issuer != ""
+}
+
+// NewProviders builds the providers from their validated configuration.
+func NewProviders(cfg map[string]config.OAuthProviderConfig) map[string]*Provider {
+	providers := map[string]*Provider{}
+
+	for name, c := range cfg {
+		providers[name] = &Provider{
+			Name:               name,
+			ClientID:           c.ClientID,
+			ClientSecret:       string(c.ClientSecret),
+			RedirectURL:        c.RedirectURL,
+			Issuer:             c.Issuer,
+			AuthURL:            c.AuthURL,
+			TokenURL:           c.TokenURL,
+			UserInfoURL:        c.UserInfoURL,
+			Scopes:             c.Scopes,
+			SubjectField:       c.SubjectField,
+			EmailField:         c.EmailField,
+			EmailVerifiedField: c.EmailVerifiedField,
+			UsernameField:      c.UsernameField,
+		}
+	}
+
+	return providers
+}
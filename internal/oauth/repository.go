@@ -0,0 +1,48 @@
+package oauth
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{db: db}
+}
+
+func (r *Repository) CreateLoginState(state *LoginState) error {
+	return r.db.Create(state).Error
+}
+
+// ConsumeLoginState deletes the state and returns it, so each authorization
+// response can be redeemed once.
+func (r *Repository) ConsumeLoginState(state, provider string) (*LoginState, error) {
+	var loginState LoginState
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("state = ? AND provider = ? AND expires_at > ?", state, provider, time.Now()).
+			First(&loginState).Error; err != nil {
+			return err
+		}
+
+		result := tx.Delete(&loginState)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("invalid or expired state")
+		}
+		return nil, err
+	}
+	return &loginState, nil
+}
@@ -0,0 +1,283 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// loginStateDuration is how long a user has to finish signing in at the
+// provider.
+const loginStateDuration = 10 * time.Minute
+
+type Service struct {
+	repo       *Repository
+	providers  map[string]*Provider
+	oidc       map[string]*oidcClient
+	httpClient *http.Client
+}
+
+func NewService(db *gorm.DB, providers map[string]*Provider) *Service {
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+
+	oidc := map[string]*oidcClient{}
+	for name, p := range providers {
+		if p.IsOIDC() {
+			oidc[name] = &oidcClient{provider: p, httpClient: httpClient}
+		}
+	}
+
+	return &Service{
+		repo:       NewRepository(db),
+		providers:  providers,
+		oidc:       oidc,
+		httpClient: httpClient,
+	}
+}
+
+// Providers lists the names of the configured providers.
+func (s *Service) Providers() []string {
+	names := make([]string, 0, len(s.providers))
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	return names
+}
+
+// AuthorizationURL starts an authorization-code flow with PKCE and returns
+// the URL to send the user to, and the state secret the client must send
+// back with the callback. The secret ties the flow to the client that
+// started it, so a code and state from someone else's flow can't be
+// completed there. linkUserID is set to link the provider to an already
+// signed-in account instead of logging in.
+func (s *Service) AuthorizationURL(ctx context.Context, providerName string, linkUserID *uint) (authURL, stateSecret string, err error) {
+	p, ok := s.providers[providerName]
+	if !ok {
+		return "", "", errors.New("unknown oauth provider")
+	}
+
+	authURL = p.AuthURL
+	if p.IsOIDC() {
+		meta, err := s.oidc[providerName].discover(ctx)
+		if err != nil {
+			return "", "", err
+		}
+		authURL = meta.AuthorizationEndpoint
+	}
+
+	state, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	stateSecret, err = randomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := s.repo.CreateLoginState(&LoginState{
+		State:        state,
+		Provider:     providerName,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		SecretHash:   hashSecret(stateSecret),
+		UserID:       linkUserID,
+		ExpiresAt:    time.Now().Add(loginStateDuration),
+	}); err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.RedirectURL)
+	params.Set("state", state)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	if len(p.Scopes) > 0 {
+		params.Set("scope", strings.Join(p.Scopes, " "))
+	}
+	if p.IsOIDC() {
+		params.Set("nonce", nonce)
+	}
+
+	separator := "?"
+	if strings.Contains(authURL, "?") {
+		separator = "&"
+	}
+	return authURL + separator + params.Encode(), stateSecret, nil
+}
+
+// Complete redeems the authorization code returned with state and resolves
+// the identity of the user at the provider. stateSecret must be the one
+// AuthorizationURL returned for state. userID is the signed-in user, if any:
+// a flow started to link a provider can only be completed by the user who
+// started it, and a login flow only without one.
+func (s *Service) Complete(ctx context.Context, providerName, code, state, stateSecret string, userID *uint) (*Result, error) {
+	p, ok := s.providers[providerName]
+	if !ok {
+		return nil, errors.New("unknown oauth provider")
+	}
+
+	loginState, err := s.repo.ConsumeLoginState(state, providerName)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(stateSecret)), []byte(loginState.SecretHash)) != 1 {
+		return nil, errors.New("invalid or expired state")
+	}
+	switch {
+	case loginState.UserID == nil && userID != nil:
+		return nil, errors.New("state was not issued to link an account")
+	case loginState.UserID != nil && (userID == nil || *userID != *loginState.UserID):
+		return nil, errors.New("state was issued to link another account")
+	}
+
+	tokenURL, userInfoURL := p.TokenURL, p.UserInfoURL
+	if p.IsOIDC() {
+		meta, err := s.oidc[providerName].discover(ctx)
+		if err != nil {
+			return nil, err
+		}
+		tokenURL, userInfoURL = meta.TokenEndpoint, meta.UserInfoEndpoint
+	}
+
+	tokens, err := s.exchangeCode(ctx, p, tokenURL, code, loginState.CodeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if p.IsOIDC() {
+		if tokens.IDToken == "" {
+			return nil, errors.New("provider did not return an id token")
+		}
+		claims, err = s.oidc[providerName].verifyIDToken(ctx, tokens.IDToken, loginState.Nonce)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if err := getJSON(ctx, s.httpClient, userInfoURL, tokens.AccessToken, &claims); err != nil {
+			return nil, fmt.Errorf("fetch userinfo: %w", err)
+		}
+	}
+
+	info := UserInfo{
+		Provider:      providerName,
+		Subject:       claimString(claims, p.SubjectField),
+		Email:         strings.ToLower(claimString(claims, p.EmailField)),
+		EmailVerified: claimBool(claims, p.EmailVerifiedField),
+		Username:      claimString(claims, p.UsernameField),
+	}
+	if info.Subject == "" {
+		return nil, errors.New("provider did not return a subject")
+	}
+
+	return &Result{
+		UserInfo:   info,
+		LinkUserID: loginState.UserID,
+	}, nil
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	TokenType   string `json:"token_type"`
+	Error       string `json:"error"`
+}
+
+func (s *Service) exchangeCode(ctx context.Context, p *Provider, tokenURL, code, verifier string) (*tokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var tokens tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token exchange: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("token exchange failed: %s %s", resp.Status, tokens.Error)
+	}
+	if tokens.AccessToken == "" {
+		return nil, errors.New("token exchange returned no access token")
+	}
+
+	return &tokens, nil
+}
+
+func randomString(length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// claimString reads a string claim. Numeric IDs, as returned by some userinfo
+// endpoints, are formatted without a fraction.
+func claimString(claims map[string]interface{}, key string) string {
+	switch v := claims[key].(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%.0f", v)
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+// claimBool reads a boolean claim, accepting "true" as sent by some issuers.
+func claimBool(claims map[string]interface{}, key string) bool {
+	switch v := claims[key].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
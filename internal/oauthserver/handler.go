@@ -0,0 +1,338 @@
+package oauthserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"rideaware/internal/config"
+	"rideaware/internal/middleware"
+	"rideaware/internal/scope"
+	"rideaware/internal/user"
+	"rideaware/pkg/utils"
+)
+
+type Handler struct {
+	service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{
+		service: service,
+	}
+}
+
+type ScopeDescription struct {
+	Scope       string `json:"scope"`
+	Description string `json:"description"`
+}
+
+type ConsentResponse struct {
+	ClientID    string             `json:"client_id"`
+	ClientName  string             `json:"client_name"`
+	RedirectURI string             `json:"redirect_uri"`
+	Scopes      []ScopeDescription `json:"scopes"`
+	State       string             `json:"state"`
+}
+
+// RegisterClient POST /api/protected/oauth2/clients
+func (h *Handler) RegisterClient(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	var req struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	secret, client, err := h.service.RegisterClient(r.Context(), claims.UserID, req.Name, req.RedirectURIs, req.Scopes, req.Confidential)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	resp := map[string]interface{}{
+		"id":            client.ID,
+		"client_id":     client.ClientID,
+		"name":          client.Name,
+		"redirect_uris": client.RedirectURIList(),
+		"scopes":        client.ScopeList(),
+		"created_at":    client.CreatedAt,
+	}
+	if secret != "" {
+		resp["client_secret"] = secret
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// GetClients GET /api/protected/oauth2/clients
+func (h *Handler) GetClients(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	clients, err := h.service.GetUserClients(claims.UserID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch clients"})
+		return
+	}
+
+	resp := make([]map[string]interface{}, 0, len(clients))
+	for _, client := range clients {
+		resp = append(resp, map[string]interface{}{
+			"id":            client.ID,
+			"client_id":     client.ClientID,
+			"name":          client.Name,
+			"redirect_uris": client.RedirectURIList(),
+			"scopes":        client.ScopeList(),
+			"confidential":  client.IsConfidential(),
+			"created_at":    client.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// DeleteClient DELETE /api/protected/oauth2/clients?id=
+func (h *Handler) DeleteClient(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 32)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid client id"})
+		return
+	}
+
+	if err := h.service.DeleteClient(r.Context(), uint(id), claims.UserID); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetConsent GET /api/protected/oauth2/authorize
+//
+// The web app calls this with the query string of the authorization request
+// to render the consent screen.
+func (h *Handler) GetConsent(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	req := AuthorizationRequest{
+		ResponseType:        q.Get("response_type"),
+		ClientID:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		Scope:               q.Get("scope"),
+		State:               q.Get("state"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+	}
+
+	client, scopes, err := h.service.ValidateAuthorization(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	descriptions := make([]ScopeDescription, 0, len(scopes))
+	for _, sc := range scopes {
+		descriptions = append(descriptions, ScopeDescription{Scope: sc, Description: scope.Description(sc)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ConsentResponse{
+		ClientID:    client.ClientID,
+		ClientName:  client.Name,
+		RedirectURI: req.RedirectURI,
+		Scopes:      descriptions,
+		State:       req.State,
+	})
+}
+
+// Authorize POST /api/protected/oauth2/authorize
+func (h *Handler) Authorize(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	var req struct {
+		AuthorizationRequest
+		Approve bool `json:"approve"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	redirectTo, err := h.service.Authorize(r.Context(), claims.UserID, req.AuthorizationRequest, req.Approve)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"redirect_to": redirectTo})
+}
+
+// GetGrants GET /api/protected/oauth2/grants
+func (h *Handler) GetGrants(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	grants, err := h.service.GetUserGrants(claims.UserID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch authorized apps"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grants)
+}
+
+// RevokeGrant DELETE /api/protected/oauth2/grants?client_id=
+func (h *Handler) RevokeGrant(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	clientID := r.URL.Query().Get("client_id")
+	if clientID == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid client id"})
+		return
+	}
+
+	if err := h.service.RevokeGrant(r.Context(), claims.UserID, clientID); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Token POST /oauth2/token
+func (h *Handler) Token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, &Error{Code: "invalid_request", Description: "invalid form body"})
+		return
+	}
+
+	client, err := h.authenticateClient(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	info := user.SessionInfo{
+		UserAgent: r.UserAgent(),
+		IPAddress: utils.ClientIP(r),
+	}
+
+	var resp *TokenResponse
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		resp, err = h.service.ExchangeCode(r.Context(), client,
+			r.PostForm.Get("code"),
+			r.PostForm.Get("redirect_uri"),
+			r.PostForm.Get("code_verifier"),
+			info,
+		)
+	case "refresh_token":
+		resp, err = h.service.Refresh(client, r.PostForm.Get("refresh_token"), info)
+	default:
+		err = &Error{Code: "unsupported_grant_type", Description: "grant_type must be authorization_code or refresh_token"}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Revoke POST /oauth2/revoke
+func (h *Handler) Revoke(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, &Error{Code: "invalid_request", Description: "invalid form body"})
+		return
+	}
+
+	client, err := h.authenticateClient(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := h.service.Revoke(client, r.PostForm.Get("token")); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "temporarily_unavailable"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// authenticateClient reads the client credentials from HTTP Basic
+// authentication or the form body.
+func (h *Handler) authenticateClient(r *http.Request) (*Client, error) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	if clientID == "" {
+		return nil, &Error{Code: "invalid_client", Description: "client authentication failed"}
+	}
+	return h.service.AuthenticateClient(clientID, secret)
+}
+
+// writeError writes an OAuth2 error response. Failed client authentication
+// is a 401, everything else a 400.
+func writeError(w http.ResponseWriter, err error) {
+	var oauthErr *Error
+	if !errors.As(err, &oauthErr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "server_error"})
+		return
+	}
+
+	status := http.StatusBadRequest
+	if oauthErr.Code == "invalid_client" {
+		status = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", `Basic realm="rideaware"`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             oauthErr.Code,
+		"error_description": strings.TrimSpace(oauthErr.Description),
+	})
+}
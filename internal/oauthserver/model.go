@@ -0,0 +1,104 @@
+package oauthserver
+
+import (
+	"strings"
+	"time"
+)
+
+// ClientIDPrefix starts every client_id issued to a registered application.
+const ClientIDPrefix = "rwc_"
+
+// Client is a third-party application registered to request access to
+// RideAware accounts. Confidential clients authenticate at the token
+// endpoint with a secret, of which only the SHA-256 hash is stored; public
+// clients such as mobile apps have none and rely on PKCE alone.
+type Client struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	UserID       uint       `gorm:"not null;index" json:"user_id"` // the developer who registered it
+	ClientID     string     `gorm:"uniqueIndex;not null" json:"client_id"`
+	SecretHash   string     `gorm:"default:''" json:"-"`
+	Name         string     `gorm:"not null" json:"name"`
+	RedirectURIs string     `gorm:"not null" json:"-"` // space separated
+	Scopes       string     `gorm:"not null" json:"-"` // space separated, the most it may request
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+func (Client) TableName() string {
+	return "oauth_clients"
+}
+
+// AuthorizationCode is the short-lived, single-use code handed to the client
+// through the redirect after the user consented. FamilyID is the session
+// family it was exchanged for, revoked if the code is ever replayed.
+type AuthorizationCode struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	UserID        uint       `gorm:"not null;index" json:"user_id"`
+	ClientID      string     `gorm:"not null;index" json:"client_id"`
+	CodeHash      string     `gorm:"uniqueIndex;not null" json:"-"`
+	RedirectURI   string     `gorm:"not null" json:"redirect_uri"`
+	Scopes        string     `gorm:"not null" json:"-"`
+	CodeChallenge string     `gorm:"not null" json:"-"`
+	FamilyID      string     `gorm:"default:''" json:"-"`
+	ExpiresAt     time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt        *time.Time `json:"used_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+func (AuthorizationCode) TableName() string {
+	return "oauth_authorization_codes"
+}
+
+// RedirectURIList returns the redirect URIs registered for the client
+func (c *Client) RedirectURIList() []string {
+	return strings.Fields(c.RedirectURIs)
+}
+
+// ScopeList returns the scopes the client may request
+func (c *Client) ScopeList() []string {
+	return strings.Fields(c.Scopes)
+}
+
+// IsConfidential checks if the client was issued a secret
+func (c *Client) IsConfidential() bool {
+	return c.SecretHash != ""
+}
+
+// AllowsRedirect checks if uri exactly matches a registered redirect URI
+func (c *Client) AllowsRedirect(uri string) bool {
+	for _, registered := range c.RedirectURIList() {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// Grant is an application a user has authorized, one per session family.
+type Grant struct {
+	ID           string    `json:"id"`
+	ClientID     string    `json:"client_id"`
+	ClientName   string    `json:"client_name"`
+	Scopes       []string  `json:"scopes"`
+	LastActiveAt time.Time `json:"last_active_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// TokenResponse is the token endpoint's successful response.
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// Error is an OAuth2 error response (RFC 6749 section 5.2).
+type Error struct {
+	Code        string
+	Description string
+}
+
+func (e *Error) Error() string {
+	return e.Description
+}
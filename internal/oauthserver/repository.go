@@ -0,0 +1,160 @@
+package oauthserver
+
+import (
+	"errors"
+	"time"
+
+	"rideaware/internal/user"
+
+	"gorm.io/gorm"
+)
+
+// errCodeReplayed is returned by ConsumeCode for a code that was already
+// exchanged.
+var errCodeReplayed = errors.New("authorization code was already used")
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{db: db}
+}
+
+// WithTx returns a repository that runs its queries in tx, see
+// database.UnitOfWork.
+func (r *Repository) WithTx(tx *gorm.DB) *Repository {
+	return &Repository{db: tx}
+}
+
+func (r *Repository) CreateClient(client *Client) error {
+	return r.db.Create(client).Error
+}
+
+// GetActiveClient looks up a client that has not been deleted.
+func (r *Repository) GetActiveClient(clientID string) (*Client, error) {
+	var client Client
+	if err := r.db.Where("client_id = ? AND revoked_at IS NULL", clientID).First(&client).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("client not found")
+		}
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (r *Repository) GetUserClients(userID uint) ([]Client, error) {
+	var clients []Client
+	if err := r.db.
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Order("created_at DESC").
+		Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// RevokeClient deletes a client and signs out every session issued to it.
+func (r *Repository) RevokeClient(id, userID uint) (*Client, error) {
+	var client Client
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).First(&client).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errors.New("client not found")
+			}
+			return err
+		}
+
+		now := time.Now()
+		if err := tx.Model(&client).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&user.Session{}).
+			Where("client_id = ? AND revoked_at IS NULL", client.ClientID).
+			Update("revoked_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (r *Repository) CreateCode(code *AuthorizationCode) error {
+	return r.db.Create(code).Error
+}
+
+// GetCode returns the authorization code with the given hash, used or not.
+func (r *Repository) GetCode(codeHash string) (*AuthorizationCode, error) {
+	var code AuthorizationCode
+	if err := r.db.Where("code_hash = ?", codeHash).First(&code).Error; err != nil {
+		return nil, errors.New("invalid authorization code")
+	}
+	return &code, nil
+}
+
+// ConsumeCode marks an unused, unexpired code as used. It returns
+// errCodeReplayed when another exchange spent the code first.
+func (r *Repository) ConsumeCode(id uint) error {
+	result := r.db.Model(&AuthorizationCode{}).
+		Where("id = ? AND used_at IS NULL AND expires_at > ?", id, time.Now()).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errCodeReplayed
+	}
+	return nil
+}
+
+func (r *Repository) SetCodeFamily(id uint, familyID string) error {
+	return r.db.Model(&AuthorizationCode{}).Where("id = ?", id).Update("family_id", familyID).Error
+}
+
+// GetUserGrants returns the live session of every client family of the user.
+func (r *Repository) GetUserGrants(userID uint) ([]user.Session, error) {
+	var sessions []user.Session
+	if err := r.db.
+		Where("user_id = ? AND client_id <> '' AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("created_at DESC").
+		Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// GetClientsByID returns the clients with the given client_ids, deleted ones
+// included.
+func (r *Repository) GetClientsByID(clientIDs []string) ([]Client, error) {
+	var clients []Client
+	if err := r.db.Where("client_id IN ?", clientIDs).Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// RevokeUserGrant signs the user out of every session of one client.
+func (r *Repository) RevokeUserGrant(userID uint, clientID string) error {
+	result := r.db.Model(&user.Session{}).
+		Where("user_id = ? AND client_id = ? AND revoked_at IS NULL", userID, clientID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("grant not found")
+	}
+	return nil
+}
+
+// RevokeFamily revokes a session family issued to clientID.
+func (r *Repository) RevokeFamily(clientID, familyID string) error {
+	return r.db.Model(&user.Session{}).
+		Where("client_id = ? AND family_id = ? AND revoked_at IS NULL", clientID, familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// DeleteExpiredCodes removes codes that can no longer be exchanged.
+func (r *Repository) DeleteExpiredCodes(before time.Time) error {
+	return r.db.Where("expires_at < ?", before).Delete(&AuthorizationCode{}).Error
+}
@@ -0,0 +1,469 @@
+package oauthserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"rideaware/internal/audit"
+	"rideaware/internal/config"
+	"rideaware/internal/scope"
+	"rideaware/internal/user"
+	"rideaware/pkg/database"
+
+	"gorm.io/gorm"
+)
+
+const (
+	authorizationCodeDuration = 5 * time.Minute
+	maxRedirectURIs           = 10
+)
+
+type Service struct {
+	repo  *Repository
+	users *user.Service
+	audit *audit.Service
+	uow   *database.UnitOfWork
+}
+
+func NewService(db *gorm.DB, users *user.Service, auditor *audit.Service) *Service {
+	return &Service{
+		repo:  NewRepository(db),
+		users: users,
+		audit: auditor,
+		uow:   database.NewUnitOfWork(db),
+	}
+}
+
+// RegisterClient registers an application owned by userID. The secret of a
+// confidential client is only returned here.
+func (s *Service) RegisterClient(ctx context.Context, userID uint, name string, redirectURIs, scopes []string, confidential bool) (string, *Client, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, errors.New("name is required")
+	}
+	if len(redirectURIs) == 0 || len(redirectURIs) > maxRedirectURIs {
+		return "", nil, errors.New("between 1 and 10 redirect URIs are required")
+	}
+	for _, uri := range redirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			return "", nil, err
+		}
+	}
+	if len(scopes) == 0 {
+		return "", nil, errors.New("at least one scope is required")
+	}
+	for _, sc := range scopes {
+		if !scope.Valid(sc) {
+			return "", nil, errors.New("unknown scope " + sc)
+		}
+	}
+
+	clientID, err := generateToken(16)
+	if err != nil {
+		return "", nil, err
+	}
+
+	client := &Client{
+		UserID:       userID,
+		ClientID:     ClientIDPrefix + clientID,
+		Name:         name,
+		RedirectURIs: strings.Join(redirectURIs, " "),
+		Scopes:       strings.Join(scopes, " "),
+	}
+
+	var secret string
+	if confidential {
+		if secret, err = generateToken(32); err != nil {
+			return "", nil, err
+		}
+		client.SecretHash = hashToken(secret)
+	}
+
+	if err := s.repo.CreateClient(client); err != nil {
+		return "", nil, err
+	}
+
+	event := audit.UserEvent(userID, audit.ActionOAuthClientRegistered)
+	event.Changes = audit.Changes{"client_id": {To: client.ClientID}}
+	s.audit.Record(ctx, event)
+
+	return secret, client, nil
+}
+
+func (s *Service) GetUserClients(userID uint) ([]Client, error) {
+	return s.repo.GetUserClients(userID)
+}
+
+// DeleteClient deletes a client and revokes every token issued to it.
+func (s *Service) DeleteClient(ctx context.Context, id, userID uint) error {
+	client, err := s.repo.RevokeClient(id, userID)
+	if err != nil {
+		return err
+	}
+
+	event := audit.UserEvent(userID, audit.ActionOAuthClientDeleted)
+	event.Changes = audit.Changes{"client_id": {From: client.ClientID}}
+	s.audit.Record(ctx, event)
+	return nil
+}
+
+// AuthorizationRequest holds the parameters of an authorization request
+// (RFC 6749 section 4.1.1 with PKCE, RFC 7636).
+type AuthorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// ValidateAuthorization checks an authorization request and returns the
+// client and the scopes it asks for, for the consent screen. PKCE with S256
+// is required from every client.
+func (s *Service) ValidateAuthorization(req AuthorizationRequest) (*Client, []string, error) {
+	client, err := s.repo.GetActiveClient(req.ClientID)
+	if err != nil {
+		return nil, nil, &Error{Code: "invalid_client", Description: "unknown client"}
+	}
+	if !client.AllowsRedirect(req.RedirectURI) {
+		return nil, nil, &Error{Code: "invalid_request", Description: "redirect_uri is not registered for this client"}
+	}
+	if req.ResponseType != "code" {
+		return nil, nil, &Error{Code: "unsupported_response_type", Description: "only the code response type is supported"}
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return nil, nil, &Error{Code: "invalid_request", Description: "a PKCE code_challenge with method S256 is required"}
+	}
+
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		return nil, nil, &Error{Code: "invalid_scope", Description: "at least one scope is required"}
+	}
+	allowed := client.ScopeList()
+	for _, sc := range scopes {
+		if !scope.Contains(allowed, sc) {
+			return nil, nil, &Error{Code: "invalid_scope", Description: "scope " + sc + " is not available to this client"}
+		}
+	}
+
+	return client, scopes, nil
+}
+
+// Authorize records the user's decision on an authorization request and
+// returns the URI to send the user back to: with a code when approved, or
+// with an access_denied error.
+func (s *Service) Authorize(ctx context.Context, userID uint, req AuthorizationRequest, approved bool) (string, error) {
+	client, scopes, err := s.ValidateAuthorization(req)
+	if err != nil {
+		return "", err
+	}
+
+	if !approved {
+		return redirectWith(req.RedirectURI, map[string]string{
+			"error": "access_denied",
+			"state": req.State,
+		})
+	}
+
+	code, err := generateToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.repo.CreateCode(&AuthorizationCode{
+		UserID:        userID,
+		ClientID:      client.ClientID,
+		CodeHash:      hashToken(code),
+		RedirectURI:   req.RedirectURI,
+		Scopes:        strings.Join(scopes, " "),
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().Add(authorizationCodeDuration),
+	}); err != nil {
+		return "", err
+	}
+
+	// Codes are kept for a day after they expire so a replay can still be
+	// detected, then dropped here instead of in a separate job.
+	if err := s.repo.DeleteExpiredCodes(time.Now().Add(-24 * time.Hour)); err != nil {
+		log.Printf("Failed to delete expired authorization codes: %v", err)
+	}
+
+	event := audit.UserEvent(userID, audit.ActionOAuthAuthorized)
+	event.Changes = audit.Changes{
+		"client_id": {To: client.ClientID},
+		"scopes":    {To: scopes},
+	}
+	s.audit.Record(ctx, event)
+
+	return redirectWith(req.RedirectURI, map[string]string{
+		"code":  code,
+		"state": req.State,
+	})
+}
+
+// AuthenticateClient identifies the client calling the token or revocation
+// endpoint. Confidential clients must present their secret.
+func (s *Service) AuthenticateClient(clientID, secret string) (*Client, error) {
+	client, err := s.repo.GetActiveClient(clientID)
+	if err != nil {
+		return nil, &Error{Code: "invalid_client", Description: "client authentication failed"}
+	}
+	if client.IsConfidential() &&
+		subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, &Error{Code: "invalid_client", Description: "client authentication failed"}
+	}
+	return client, nil
+}
+
+// ExchangeCode redeems an authorization code for a token pair. A code that
+// is presented twice revokes the tokens issued for it, as it has leaked.
+func (s *Service) ExchangeCode(ctx context.Context, client *Client, code, redirectURI, codeVerifier string, info user.SessionInfo) (*TokenResponse, error) {
+	invalidGrant := &Error{Code: "invalid_grant", Description: "invalid or expired authorization code"}
+
+	authCode, err := s.repo.GetCode(hashToken(code))
+	if err != nil {
+		return nil, invalidGrant
+	}
+
+	// Everything is checked before the code is spent, so presenting it with
+	// the wrong client or redirect_uri doesn't burn it
+	if authCode.ClientID != client.ClientID || authCode.RedirectURI != redirectURI {
+		return nil, invalidGrant
+	}
+	if authCode.UsedAt != nil {
+		s.revokeReplayedCode(authCode)
+		return nil, invalidGrant
+	}
+	if !authCode.ExpiresAt.After(time.Now()) {
+		return nil, invalidGrant
+	}
+	if !verifyCodeChallenge(codeVerifier, authCode.CodeChallenge) {
+		return nil, &Error{Code: "invalid_grant", Description: "code_verifier does not match the code_challenge"}
+	}
+
+	u, err := s.users.GetActiveUser(authCode.UserID)
+	if err != nil {
+		return nil, invalidGrant
+	}
+
+	// The code is spent and linked to its session in the same transaction,
+	// so a replay can always find the tokens to revoke
+	info.DeviceName = client.Name
+	var session *user.Session
+	err = s.uow.Do(ctx, func(tx *gorm.DB) error {
+		codes := s.repo.WithTx(tx)
+		if err := codes.ConsumeCode(authCode.ID); err != nil {
+			return err
+		}
+		var err error
+		session, err = s.users.WithTx(tx).CreateClientSession(u.ID, client.ClientID, strings.Fields(authCode.Scopes), info)
+		if err != nil {
+			return err
+		}
+		return codes.SetCodeFamily(authCode.ID, session.FamilyID)
+	})
+	if errors.Is(err, errCodeReplayed) {
+		// A concurrent exchange won; its tokens are revoked as well
+		if spent, err := s.repo.GetCode(authCode.CodeHash); err == nil {
+			s.revokeReplayedCode(spent)
+		}
+		return nil, invalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return issueTokens(u, session)
+}
+
+// revokeReplayedCode revokes the tokens issued for a code that was presented
+// again (RFC 6749 section 4.1.2).
+func (s *Service) revokeReplayedCode(code *AuthorizationCode) {
+	if code.UsedAt == nil || code.FamilyID == "" {
+		return
+	}
+	if err := s.repo.RevokeFamily(code.ClientID, code.FamilyID); err != nil {
+		log.Printf("Failed to revoke tokens of replayed code %d: %v", code.ID, err)
+	}
+}
+
+// Refresh rotates a client's refresh token, with the same reuse detection as
+// first-party sessions.
+func (s *Service) Refresh(client *Client, refreshToken string, info user.SessionInfo) (*TokenResponse, error) {
+	invalidGrant := &Error{Code: "invalid_grant", Description: "invalid or expired refresh token"}
+
+	claims, err := config.VerifyToken(refreshToken)
+	if err != nil || claims.TokenType != "refresh" || claims.ID == "" || claims.ClientID != client.ClientID {
+		return nil, invalidGrant
+	}
+
+	u, session, err := s.users.RefreshSession(claims.ID, client.ClientID, info)
+	if err != nil || u.ID != claims.UserID {
+		return nil, invalidGrant
+	}
+
+	return issueTokens(u, session)
+}
+
+// Revoke revokes the session family of an access or refresh token issued to
+// client (RFC 7009). Unknown tokens are ignored.
+func (s *Service) Revoke(client *Client, token string) error {
+	claims, err := config.VerifyToken(token)
+	if err != nil || claims.ClientID != client.ClientID || claims.SessionID == "" {
+		return nil
+	}
+	return s.repo.RevokeFamily(client.ClientID, claims.SessionID)
+}
+
+// GetUserGrants lists the applications the user has authorized.
+func (s *Service) GetUserGrants(userID uint) ([]Grant, error) {
+	sessions, err := s.repo.GetUserGrants(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := make([]Grant, 0, len(sessions))
+	if len(sessions) == 0 {
+		return grants, nil
+	}
+
+	clientIDs := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		clientIDs = append(clientIDs, session.ClientID)
+	}
+	clients, err := s.repo.GetClientsByID(clientIDs)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(clients))
+	for _, client := range clients {
+		names[client.ClientID] = client.Name
+	}
+
+	for _, session := range sessions {
+		grants = append(grants, Grant{
+			ID:           session.FamilyID,
+			ClientID:     session.ClientID,
+			ClientName:   names[session.ClientID],
+			Scopes:       session.ScopeList(),
+			LastActiveAt: session.CreatedAt,
+			ExpiresAt:    session.ExpiresAt,
+		})
+	}
+	return grants, nil
+}
+
+// RevokeGrant withdraws the user's authorization of a client.
+func (s *Service) RevokeGrant(ctx context.Context, userID uint, clientID string) error {
+	if err := s.repo.RevokeUserGrant(userID, clientID); err != nil {
+		return err
+	}
+
+	event := audit.UserEvent(userID, audit.ActionOAuthGrantRevoked)
+	event.Changes = audit.Changes{"client_id": {From: clientID}}
+	s.audit.Record(ctx, event)
+	return nil
+}
+
+// issueTokens signs an access token limited to the session's scopes and a
+// refresh token bound to it. Client tokens carry no role or permissions.
+func issueTokens(u *user.User, session *user.Session) (*TokenResponse, error) {
+	claims := config.CustomClaims{
+		UserID:        u.ID,
+		Email:         u.Email,
+		EmailVerified: u.IsEmailVerified(),
+		Username:      u.Username,
+		SessionID:     session.FamilyID,
+		Scopes:        session.ScopeList(),
+		ClientID:      session.ClientID,
+	}
+
+	accessToken, err := config.GenerateAccessToken(claims)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := config.GenerateRefreshToken(claims, session.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(config.JWT.AccessTokenDuration.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        session.Scopes,
+	}, nil
+}
+
+// validateRedirectURI accepts absolute https URIs, http only on loopback
+// addresses for local development, and private-use schemes of native apps.
+func validateRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" || u.Fragment != "" {
+		return errors.New("invalid redirect URI " + uri)
+	}
+
+	switch u.Scheme {
+	case "https":
+		if u.Host == "" {
+			return errors.New("invalid redirect URI " + uri)
+		}
+	case "http":
+		host := u.Hostname()
+		if host != "localhost" && host != "127.0.0.1" && host != "::1" {
+			return errors.New("http redirect URIs are only allowed for localhost")
+		}
+	case "javascript", "data", "file":
+		return errors.New("invalid redirect URI " + uri)
+	}
+	return nil
+}
+
+func redirectWith(uri string, params map[string]string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for key, value := range params {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func generateToken(length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,44 @@
+package passwordpolicy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BreachedList is a directory of k-anonymity range files in the format
+// served by the Pwned Passwords range API: one file per 5 character SHA-1
+// prefix, named <PREFIX>.txt, whose lines are the remaining 35 characters of
+// a breached hash followed by ":<count>". Only the file for a password's
+// prefix is ever read.
+type BreachedList string
+
+// Contains reports whether password's SHA-1 hash is in the list. A missing
+// range file means none of the hashes with that prefix are listed.
+func (l BreachedList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(string(l), prefix+".txt"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		candidate, _, _ := strings.Cut(line, ":")
+		if strings.EqualFold(candidate, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
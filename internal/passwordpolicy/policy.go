@@ -0,0 +1,130 @@
+// Package passwordpolicy decides whether a password is acceptable. Signup,
+// password reset and password changes all go through the same Policy.
+package passwordpolicy
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"rideaware/internal/config"
+)
+
+// Violation codes reported in a PolicyError.
+const (
+	CodeTooShort         = "too_short"
+	CodeTooLong          = "too_long"
+	CodeTooWeak          = "too_weak"
+	CodeContainsUsername = "contains_username"
+	CodeContainsEmail    = "contains_email"
+	CodeBreached         = "breached"
+)
+
+// Policy holds the configurable password rules.
+type Policy struct {
+	MinLength int
+	MaxLength int
+	// MinScore is the lowest accepted strength score, from 0 (trivial) to
+	// 4 (very strong). See Strength.
+	MinScore int
+	// BreachedHashDir is a directory of k-anonymity range files, see
+	// BreachedList. Empty disables the check.
+	BreachedHashDir string
+}
+
+// Violation is one rule a password broke.
+type Violation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PolicyError lists every rule a password broke.
+type PolicyError struct {
+	Violations []Violation
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		messages = append(messages, v.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+var current = &Policy{
+	MinLength: 8,
+	MaxLength: 128,
+	MinScore:  2,
+}
+
+// New builds the policy from its validated configuration.
+func New(cfg config.PasswordConfig) *Policy {
+	p := *current
+	p.MinLength = cfg.MinLength
+	p.MinScore = cfg.MinStrength
+	p.BreachedHashDir = cfg.BreachedHashesDir
+	return &p
+}
+
+// SetDefault replaces the policy used by Check.
+func SetDefault(p *Policy) {
+	current = p
+}
+
+// Check validates password against the configured policy for the account
+// identified by username and email.
+func Check(password, username, email string) error {
+	return current.Check(password, username, email)
+}
+
+// Check validates password for the account identified by username and email.
+// It returns a *PolicyError listing every violation, or nil.
+func (p *Policy) Check(password, username, email string) error {
+	var violations []Violation
+	add := func(code, format string, args ...interface{}) {
+		violations = append(violations, Violation{Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		add(CodeTooShort, "password must be at least %d characters long", p.MinLength)
+	}
+	if length > p.MaxLength {
+		add(CodeTooLong, "password must be at most %d characters long", p.MaxLength)
+	}
+
+	lower := strings.ToLower(password)
+	if username != "" && utf8.RuneCountInString(username) >= 3 &&
+		strings.Contains(lower, strings.ToLower(username)) {
+		add(CodeContainsUsername, "password must not contain your username")
+	}
+	if email != "" {
+		email = strings.ToLower(email)
+		local, _, _ := strings.Cut(email, "@")
+		if strings.Contains(lower, email) ||
+			(utf8.RuneCountInString(local) >= 3 && strings.Contains(lower, local)) {
+			add(CodeContainsEmail, "password must not contain your email address")
+		}
+	}
+
+	if length >= p.MinLength && length <= p.MaxLength {
+		if Strength(password) < p.MinScore {
+			add(CodeTooWeak, "password is too easy to guess, try a longer passphrase or fewer common words and patterns")
+		}
+	}
+
+	if p.BreachedHashDir != "" && password != "" {
+		breached, err := BreachedList(p.BreachedHashDir).Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			add(CodeBreached, "password has appeared in a data breach, choose a different one")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package passwordpolicy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStrength(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"password", 0},
+		{"P@ssw0rd", 0},
+		{"aaaaaaaaaa", 0},
+		{"abcdefgh", 0},
+		{"qwertyuiop", 1},
+		{"monkey123", 1},
+		{"Password2024!", 1},
+		{"zq8#Lm2v", 4},
+		{"correct horse battery staple", 4},
+	}
+
+	for _, tt := range tests {
+		if got := Strength(tt.password); got != tt.want {
+			t.Errorf("Strength(%q) = %d, want %d", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p := &Policy{MinLength: 8, MaxLength: 64, MinScore: 2}
+
+	tests := []struct {
+		name     string
+		password string
+		want     []string
+	}{
+		{"strong", "correct horse battery staple", nil},
+		{"too short", "zq8#Lm", []string{CodeTooShort}},
+		{"too long", strings.Repeat("zq8#Lm2v", 9), []string{CodeTooLong}},
+		{"too weak", "Password2024!", []string{CodeTooWeak}},
+		{"contains username", "zq8#alice-Lm2v", []string{CodeContainsUsername}},
+		{"contains username in another case", "zq8#ALICE-Lm2v", []string{CodeContainsUsername}},
+		{"contains email", "zq8#rider@example.com", []string{CodeContainsEmail}},
+		{"contains email local part", "zq8#rider-Lm2v", []string{CodeContainsEmail}},
+		{"short and weak", "pass", []string{CodeTooShort}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertViolations(t, p.Check(tt.password, "alice", "rider@example.com"), tt.want)
+		})
+	}
+}
+
+func TestCheckShortUsernameIsIgnored(t *testing.T) {
+	p := &Policy{MinLength: 8, MaxLength: 64, MinScore: 2}
+	assertViolations(t, p.Check("zq8#al-Lm2v", "al", "x@example.com"), nil)
+}
+
+func TestCheckBreached(t *testing.T) {
+	dir := t.TempDir()
+	// SHA-1 of "correct horse battery staple" is
+	// ABF7AAD6438836DBE526AA231ABDE2D0EEF74D42
+	if err := os.WriteFile(filepath.Join(dir, "ABF7A.txt"),
+		[]byte("0000000000000000000000000000000000A:3\r\nad6438836dbe526aa231abde2d0eef74d42:12\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Policy{MinLength: 8, MaxLength: 64, MinScore: 2, BreachedHashDir: dir}
+	assertViolations(t, p.Check("correct horse battery staple", "", ""), []string{CodeBreached})
+	assertViolations(t, p.Check("tangerine velvet orbit cactus", "", ""), nil)
+}
+
+func assertViolations(t *testing.T, err error, want []string) {
+	t.Helper()
+
+	if want == nil {
+		if err != nil {
+			t.Fatalf("Check = %v, want nil", err)
+		}
+		return
+	}
+
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("Check = %v, want a *PolicyError", err)
+	}
+	var got []string
+	for _, v := range policyErr.Violations {
+		got = append(got, v.Code)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("violations = %v, want %v", got, want)
+	}
+}
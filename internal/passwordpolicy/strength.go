@@ -0,0 +1,228 @@
+package passwordpolicy
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// commonWords are frequent password words, most common first. A word's
+// position stands in for how early an attacker would guess it.
+var commonWords = []string{
+	"password", "qwerty", "dragon", "baseball", "football", "letmein",
+	"monkey", "abc123", "mustang", "michael", "shadow", "master", "jennifer",
+	"jordan", "superman", "harley", "hunter", "trustno", "ranger", "buster",
+	"thomas", "tigger", "robert", "soccer", "batman", "test", "pass",
+	"killer", "hockey", "george", "charlie", "andrew", "michelle", "love",
+	"sunshine", "jessica", "asshole", "pepper", "daniel", "access", "joshua",
+	"maggie", "starwars", "silver", "william", "dallas", "yankees", "hello",
+	"amanda", "orange", "biteme", "freedom", "computer", "sexy", "thunder",
+	"nicole", "ginger", "heather", "hammer", "summer", "corvette", "taylor",
+	"fucker", "austin", "merlin", "matthew", "secret", "diamond", "welcome",
+	"princess", "iloveyou", "admin", "login", "passw", "solo", "flower",
+	"shit", "cookie", "qazwsx", "ninja", "azerty", "loveme", "whatever",
+	"donald", "zaq1", "trustme", "lovely", "snoopy", "winter", "spring",
+	"autumn", "monday", "friday", "cheese", "purple", "chocolate", "banana",
+	"changeme", "default", "guest", "root", "user", "rideaware", "ride",
+	"bike", "bicycle", "cycling", "cyclist", "rider", "strava", "zwift",
+	"garmin", "wahoo", "peloton", "tour", "france", "giro", "vuelta",
+	"mountain", "road", "racing", "speed", "power", "watts", "cadence",
+}
+
+// keyboardRows are sequences an attacker tries as patterns rather than as
+// independent characters.
+var keyboardRows = []string{
+	"qwertyuiop", "asdfghjkl", "zxcvbnm", "1234567890",
+	"azertyuiop", "qwertzuiop", "abcdefghijklmnopqrstuvwxyz",
+}
+
+var leet = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '9': 'g',
+	'1': 'i', '!': 'i', '|': 'l', '0': 'o', '$': 's', '5': 's', '7': 't',
+	'+': 't', '2': 'z',
+}
+
+// Strength estimates how hard password is to guess on the same 0-4 scale as
+// zxcvbn:
+//
+//	0  too guessable (< 10^3 guesses)
+//	1  very guessable (< 10^6)
+//	2  somewhat guessable (< 10^8)
+//	3  safely unguessable (< 10^10)
+//	4  very unguessable
+//
+// The password is split into common words, repeats, sequences, years and
+// leftover characters. Each part contributes the number of guesses needed to
+// find it on its own, so "Password2024!" is weak despite mixing character
+// classes while a long run of unrelated words is strong.
+func Strength(password string) int {
+	guesses := estimateLog10Guesses(password)
+	switch {
+	case guesses < 3:
+		return 0
+	case guesses < 6:
+		return 1
+	case guesses < 8:
+		return 2
+	case guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func estimateLog10Guesses(password string) float64 {
+	original := []rune(password)
+	lower := []rune(strings.ToLower(password))
+	normalized := make([]rune, len(lower))
+	for i, r := range lower {
+		if sub, ok := leet[r]; ok {
+			normalized[i] = sub
+		} else {
+			normalized[i] = r
+		}
+	}
+
+	total := 0.0
+	for i := 0; i < len(original); {
+		if n, guesses := matchWord(original, lower, normalized, i); n > 0 {
+			total += math.Log10(guesses)
+			i += n
+			continue
+		}
+		if n := matchYear(lower, i); n > 0 {
+			total += math.Log10(120)
+			i += n
+			continue
+		}
+		if n := matchRepeat(lower, i); n > 0 {
+			total += math.Log10(cardinality(original[i]) * float64(n))
+			i += n
+			continue
+		}
+		if n, descending := matchSequence(lower, i); n > 0 {
+			guesses := 26.0 * float64(n)
+			if descending {
+				guesses *= 2
+			}
+			total += math.Log10(guesses)
+			i += n
+			continue
+		}
+
+		total += math.Log10(cardinality(original[i]))
+		i++
+	}
+
+	return total
+}
+
+// matchWord finds the longest common word starting at i, returning its length
+// and the guesses needed for it including capitalisation and substitutions.
+func matchWord(original, lower, normalized []rune, i int) (int, float64) {
+	best, rank := 0, 0
+	for r, word := range commonWords {
+		w := []rune(word)
+		if len(w) < 4 || len(w) <= best || i+len(w) > len(normalized) {
+			continue
+		}
+		if string(normalized[i:i+len(w)]) == word || string(lower[i:i+len(w)]) == word {
+			best, rank = len(w), r+1
+		}
+	}
+	if best == 0 {
+		return 0, 0
+	}
+
+	guesses := float64(rank) * 10
+	span := original[i : i+best]
+	if strings.ToLower(string(span)) != string(span) {
+		guesses *= 2
+	}
+	if string(lower[i:i+best]) != string(normalized[i:i+best]) {
+		guesses *= 2
+	}
+	return best, guesses
+}
+
+// matchYear matches a four digit year from 1900 to 2099.
+func matchYear(lower []rune, i int) int {
+	if i+4 > len(lower) {
+		return 0
+	}
+	s := string(lower[i : i+4])
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return 0
+		}
+	}
+	if (s[:2] == "19" || s[:2] == "20") && !(i+4 < len(lower) && unicode.IsDigit(lower[i+4])) {
+		return 4
+	}
+	return 0
+}
+
+// matchRepeat matches three or more of the same character.
+func matchRepeat(lower []rune, i int) int {
+	n := 1
+	for i+n < len(lower) && lower[i+n] == lower[i] {
+		n++
+	}
+	if n < 3 {
+		return 0
+	}
+	return n
+}
+
+// matchSequence matches three or more characters that follow each other on
+// the keyboard or in the alphabet, in either direction.
+func matchSequence(lower []rune, i int) (int, bool) {
+	best, bestDescending := 0, false
+	for _, row := range keyboardRows {
+		for _, descending := range []bool{false, true} {
+			seq := []rune(row)
+			if descending {
+				for a, b := 0, len(seq)-1; a < b; a, b = a+1, b-1 {
+					seq[a], seq[b] = seq[b], seq[a]
+				}
+			}
+
+			start := -1
+			for k, r := range seq {
+				if r == lower[i] {
+					start = k
+					break
+				}
+			}
+			if start < 0 {
+				continue
+			}
+
+			n := 0
+			for start+n < len(seq) && i+n < len(lower) && lower[i+n] == seq[start+n] {
+				n++
+			}
+			if n > best {
+				best, bestDescending = n, descending
+			}
+		}
+	}
+	if best < 3 {
+		return 0, false
+	}
+	return best, bestDescending
+}
+
+// cardinality is the size of the character class r belongs to.
+func cardinality(r rune) float64 {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		return 26
+	case r >= '0' && r <= '9':
+		return 10
+	case r < 128:
+		return 33
+	default:
+		return 100
+	}
+}
@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Bucket is the stored state of one key's token bucket. FullAt is when it
+// will have refilled completely, after which the row can be dropped.
+type Bucket struct {
+	Key       string    `gorm:"primaryKey" json:"key"`
+	Tokens    float64   `gorm:"not null" json:"tokens"`
+	UpdatedAt time.Time `gorm:"not null" json:"updated_at"`
+	FullAt    time.Time `gorm:"not null;index" json:"full_at"`
+}
+
+func (Bucket) TableName() string {
+	return "rate_limit_buckets"
+}
+
+// PostgresStore keeps buckets in the database so every instance enforces the
+// same limits.
+type PostgresStore struct {
+	db *gorm.DB
+}
+
+func NewPostgresStore(db *gorm.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// Take locks the key's row for the duration of the update, creating a full
+// bucket first if there is none.
+func (s *PostgresStore) Take(ctx context.Context, key string, limit int, period time.Duration) (Result, error) {
+	var result Result
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Bucket{
+			Key:       key,
+			Tokens:    float64(limit),
+			UpdatedAt: now,
+			FullAt:    now,
+		}).Error; err != nil {
+			return err
+		}
+
+		var bucket Bucket
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("key = ?", key).
+			First(&bucket).Error; err != nil {
+			return err
+		}
+
+		tokens, fullAt, r := take(bucket.Tokens, bucket.UpdatedAt, now, limit, period)
+		result = r
+		return tx.Model(&Bucket{}).Where("key = ?", key).Updates(map[string]interface{}{
+			"tokens":     tokens,
+			"updated_at": now,
+			"full_at":    fullAt,
+		}).Error
+	})
+	return result, err
+}
+
+// Run deletes refilled buckets every interval until ctx is cancelled.
+func (s *PostgresStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.db.WithContext(ctx).Where("full_at <= ?", time.Now()).Delete(&Bucket{}).Error; err != nil {
+				log.Printf("Failed to prune rate limit buckets: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Package ratelimit throttles requests with token buckets. Every policy has a
+// bucket per key that holds up to Limit tokens and refills completely over
+// Period; each request takes one token and is refused while the bucket is
+// empty.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Policy is the limit applied to one group of routes. Routes sharing a policy
+// share its buckets.
+type Policy struct {
+	Name   string
+	Limit  int
+	Period time.Duration
+	Key    KeyFunc
+}
+
+// Result is the state of a bucket after a request took, or failed to take, a
+// token from it.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // until the next token, when refused
+	Reset      time.Duration // until the bucket is full again
+}
+
+// Store keeps the buckets. Take must be atomic per key, so concurrent
+// requests can never spend the same token twice.
+type Store interface {
+	Take(ctx context.Context, key string, limit int, period time.Duration) (Result, error)
+}
+
+// NewStore returns the store named by kind: "memory" (the default) keeps
+// buckets in this process, "postgres" shares them between instances.
+func NewStore(kind string, db *gorm.DB) (Store, error) {
+	switch kind {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "postgres":
+		return NewPostgresStore(db), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", kind)
+	}
+}
+
+// take refills a bucket holding tokens as of updatedAt and spends one token
+// if there is one. It returns the new token count, when the bucket will be
+// full again and the result.
+func take(tokens float64, updatedAt, now time.Time, limit int, period time.Duration) (float64, time.Time, Result) {
+	rate := float64(limit) / period.Seconds()
+
+	elapsed := now.Sub(updatedAt).Seconds()
+	if elapsed > 0 {
+		tokens = math.Min(float64(limit), tokens+elapsed*rate)
+	}
+
+	result := Result{Limit: limit}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - tokens) / rate)
+	}
+
+	result.Remaining = int(tokens)
+	result.Reset = seconds((float64(limit) - tokens) / rate)
+	return tokens, now.Add(result.Reset), result
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
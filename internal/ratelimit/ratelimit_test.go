@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rideaware/internal/config"
+	"rideaware/internal/middleware"
+)
+
+func TestTake(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+
+	tests := []struct {
+		name          string
+		tokens        float64
+		elapsed       time.Duration
+		wantAllowed   bool
+		wantRemaining int
+		wantTokens    float64
+		wantRetry     time.Duration
+		wantReset     time.Duration
+	}{
+		{"full bucket", 10, 0, true, 9, 9, 0, 6 * time.Second},
+		{"last token", 1, 0, true, 0, 0, 0, time.Minute},
+		{"empty bucket", 0, 0, false, 0, 0, 6 * time.Second, time.Minute},
+		{"partly refilled", 0, 3 * time.Second, false, 0, 0.5, 3 * time.Second, 57 * time.Second},
+		{"refilled one token", 0, 6 * time.Second, true, 0, 0, 0, time.Minute},
+		{"refill stops at the limit", 5, time.Hour, true, 9, 9, 0, 6 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := start.Add(tt.elapsed)
+			tokens, fullAt, result := take(tt.tokens, start, now, 10, time.Minute)
+
+			if result.Allowed != tt.wantAllowed || result.Remaining != tt.wantRemaining || result.Limit != 10 {
+				t.Errorf("result = %+v, want allowed %v with %d remaining", result, tt.wantAllowed, tt.wantRemaining)
+			}
+			if !approx(tokens, tt.wantTokens) {
+				t.Errorf("tokens = %v, want %v", tokens, tt.wantTokens)
+			}
+			if !approxDuration(result.RetryAfter, tt.wantRetry) || !approxDuration(result.Reset, tt.wantReset) {
+				t.Errorf("retry after %v and reset %v, want %v and %v",
+					result.RetryAfter, result.Reset, tt.wantRetry, tt.wantReset)
+			}
+			if !approxDuration(fullAt.Sub(now), tt.wantReset) {
+				t.Errorf("full in %v, want %v", fullAt.Sub(now), tt.wantReset)
+			}
+		})
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		result, err := store.Take(ctx, "a", 3, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed || result.Remaining != 2-i {
+			t.Fatalf("request %d: %+v, want allowed with %d remaining", i+1, result, 2-i)
+		}
+	}
+
+	result, err := store.Take(ctx, "a", 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.RetryAfter <= 0 {
+		t.Errorf("request over the limit: %+v, want refused with a retry time", result)
+	}
+
+	result, err = store.Take(ctx, "b", 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed || result.Remaining != 2 {
+		t.Errorf("other key: %+v, want its own full bucket", result)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	limiter := NewLimiter(NewMemoryStore())
+	policy := Policy{Name: "test", Limit: 2, Period: time.Minute, Key: ByIP}
+	handler := limiter.Limit(policy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	wantStatus := []int{http.StatusNoContent, http.StatusNoContent, http.StatusTooManyRequests}
+	for i, want := range wantStatus {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != want {
+			t.Fatalf("request %d: status %d, want %d", i+1, rec.Code, want)
+		}
+		if got := rec.Header().Get("RateLimit-Policy"); got != "2;w=60" {
+			t.Errorf("request %d: RateLimit-Policy %q", i+1, got)
+		}
+		if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("request %d: no Retry-After", i+1)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	withClaims := func(req *http.Request, claims *config.CustomClaims) *http.Request {
+		return req.WithContext(context.WithValue(req.Context(), middleware.UserContextKey, claims))
+	}
+	request := func(authorization string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return req
+	}
+
+	session := withClaims(request("Bearer access-1"), &config.CustomClaims{UserID: 7, SessionID: "family-1"})
+	refreshed := withClaims(request("Bearer access-2"), &config.CustomClaims{UserID: 7, SessionID: "family-1"})
+	pat := withClaims(request("Bearer rwpat_one"), &config.CustomClaims{UserID: 7})
+	otherPAT := withClaims(request("Bearer rwpat_two"), &config.CustomClaims{UserID: 7})
+	anonymous := request("")
+
+	if got := ByUser(session); got != "user:7" {
+		t.Errorf("ByUser = %q, want user:7", got)
+	}
+	if got := ByUser(anonymous); got != ByIP(anonymous) {
+		t.Errorf("ByUser without claims = %q, want the client address", got)
+	}
+	if got := ByToken(session); got != "session:family-1" {
+		t.Errorf("ByToken for a session = %q, want session:family-1", got)
+	}
+	if ByToken(session) != ByToken(refreshed) {
+		t.Error("ByToken changed when the session's access token was refreshed")
+	}
+	if ByToken(pat) == ByToken(otherPAT) {
+		t.Error("ByToken gave two personal access tokens the same key")
+	}
+	if got := ByToken(anonymous); got != ByIP(anonymous) {
+		t.Errorf("ByToken without claims = %q, want the client address", got)
+	}
+}
+
+func approx(a, b float64) bool {
+	d := a - b
+	return d > -1e-9 && d < 1e-9
+}
+
+func approxDuration(a, b time.Duration) bool {
+	d := a - b
+	return d > -time.Millisecond && d < time.Millisecond
+}
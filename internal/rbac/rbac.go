@@ -0,0 +1,80 @@
+package rbac
+
+import "strings"
+
+// Roles a user can hold. Every account starts as an athlete.
+const (
+	RoleAthlete = "athlete"
+	RoleCoach   = "coach"
+	RoleAdmin   = "admin"
+)
+
+// Permissions guard features beyond a user's own data. Roles grant a fixed
+// set of them; individual users can be granted extra ones.
+const (
+	AthletesRead = "athletes:read"
+	PlansWrite   = "plans:write"
+	UsersRead    = "users:read"
+	UsersWrite   = "users:write"
+	RolesWrite   = "roles:write"
+
+	// UsersImpersonate lets support staff act as another user
+	UsersImpersonate = "users:impersonate"
+)
+
+var AllPermissions = []string{
+	AthletesRead,
+	PlansWrite,
+	UsersRead,
+	UsersWrite,
+	RolesWrite,
+	UsersImpersonate,
+}
+
+var rolePermissions = map[string][]string{
+	RoleAthlete: {},
+	RoleCoach:   {AthletesRead, PlansWrite},
+	RoleAdmin:   AllPermissions,
+}
+
+// ValidRole reports whether role is a known role.
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// ValidPermission reports whether p is a known permission.
+func ValidPermission(p string) bool {
+	return contains(AllPermissions, p)
+}
+
+// Permissions returns the permissions granted by role plus any extra ones,
+// without duplicates.
+func Permissions(role string, extra []string) []string {
+	perms := append([]string{}, rolePermissions[role]...)
+	for _, p := range extra {
+		if !contains(perms, p) {
+			perms = append(perms, p)
+		}
+	}
+	return perms
+}
+
+// Has reports whether perms includes p.
+func Has(perms []string, p string) bool {
+	return contains(perms, p)
+}
+
+// ParsePermissions splits a stored space-separated permission list.
+func ParsePermissions(s string) []string {
+	return strings.Fields(s)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package scope
+
+// Scopes limit what a delegated credential, such as a personal access token
+// or an OAuth2 client's token, may do on the protected API.
+const (
+	WorkoutsRead   = "workouts:read"
+	WorkoutsWrite  = "workouts:write"
+	ProfileRead    = "profile:read"
+	ProfileWrite   = "profile:write"
+	EquipmentRead  = "equipment:read"
+	EquipmentWrite = "equipment:write"
+)
+
+var All = []string{
+	WorkoutsRead,
+	WorkoutsWrite,
+	ProfileRead,
+	ProfileWrite,
+	EquipmentRead,
+	EquipmentWrite,
+}
+
+var descriptions = map[string]string{
+	WorkoutsRead:   "View your workouts",
+	WorkoutsWrite:  "Create, change and delete your workouts",
+	ProfileRead:    "View your profile and training zones",
+	ProfileWrite:   "Change your profile",
+	EquipmentRead:  "View your equipment",
+	EquipmentWrite: "Add, change and remove your equipment",
+}
+
+// Description explains s to a user deciding whether to grant it.
+func Description(s string) string {
+	return descriptions[s]
+}
+
+// Valid reports whether s is a known scope.
+func Valid(s string) bool {
+	for _, known := range All {
+		if s == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether scopes grants s.
+func Contains(scopes []string, s string) bool {
+	for _, granted := range scopes {
+		if granted == s {
+			return true
+		}
+	}
+	return false
+}
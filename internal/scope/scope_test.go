@@ -0,0 +1,61 @@
+package scope
+
+import "testing"
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		scope string
+		want  bool
+	}{
+		{WorkoutsRead, true},
+		{WorkoutsWrite, true},
+		{ProfileRead, true},
+		{ProfileWrite, true},
+		{EquipmentRead, true},
+		{EquipmentWrite, true},
+		{"", false},
+		{"workouts", false},
+		{"workouts:delete", false},
+		{"WORKOUTS:READ", false},
+		{"admin", false},
+	}
+
+	for _, tt := range tests {
+		if got := Valid(tt.scope); got != tt.want {
+			t.Errorf("Valid(%q) = %v, want %v", tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	granted := []string{WorkoutsRead, ProfileRead}
+
+	tests := []struct {
+		scopes []string
+		scope  string
+		want   bool
+	}{
+		{granted, WorkoutsRead, true},
+		{granted, ProfileRead, true},
+		{granted, WorkoutsWrite, false},
+		{granted, "", false},
+		{nil, WorkoutsRead, false},
+	}
+
+	for _, tt := range tests {
+		if got := Contains(tt.scopes, tt.scope); got != tt.want {
+			t.Errorf("Contains(%v, %q) = %v, want %v", tt.scopes, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestEveryScopeHasADescription(t *testing.T) {
+	for _, s := range All {
+		if Description(s) == "" {
+			t.Errorf("scope %q has no description", s)
+		}
+	}
+	if got := Description("unknown"); got != "" {
+		t.Errorf("Description of an unknown scope = %q, want empty", got)
+	}
+}
@@ -0,0 +1,253 @@
+package takeout
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"rideaware/internal/profile"
+	"rideaware/internal/user"
+	"rideaware/internal/workout"
+)
+
+// FormatVersion is bumped whenever the layout of the archive changes.
+const FormatVersion = 1
+
+// Manifest describes an archive. It is written as manifest.json.
+type Manifest struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	UserID     uint      `json:"user_id"`
+	Username   string    `json:"username"`
+}
+
+// Account is the account and profile record written as account.json.
+type Account struct {
+	ID              uint          `json:"id"`
+	Username        string        `json:"username"`
+	Email           string        `json:"email"`
+	EmailVerifiedAt *time.Time    `json:"email_verified_at"`
+	Role            string        `json:"role"`
+	CreatedAt       time.Time     `json:"created_at"`
+	Profile         *user.Profile `json:"profile"`
+}
+
+// WorkoutRecord is a workout as written to workouts.json. OriginalFile is the
+// path of the uploaded file inside the archive, if there is one.
+type WorkoutRecord struct {
+	workout.Workout
+	OriginalFile string `json:"original_file,omitempty"`
+}
+
+// SessionRecord is the metadata kept about one sign-in.
+type SessionRecord struct {
+	SessionID  string     `json:"session_id"`
+	DeviceName string     `json:"device_name"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// archiveData is everything that goes into one archive.
+type archiveData struct {
+	manifest  Manifest
+	account   Account
+	workouts  []workout.Workout
+	equipment []profile.Equipment
+	sessions  []user.Session
+}
+
+// writeArchive writes data to w as a ZIP archive with a JSON and a CSV copy
+// of every record type and the original workout uploads.
+func writeArchive(w io.Writer, data *archiveData) error {
+	zw := zip.NewWriter(w)
+
+	if err := writeJSON(zw, "manifest.json", data.manifest); err != nil {
+		return err
+	}
+	if err := writeJSON(zw, "account.json", data.account); err != nil {
+		return err
+	}
+	if err := writeCSV(zw, "account.csv", accountRows(data.account)); err != nil {
+		return err
+	}
+
+	workouts := make([]WorkoutRecord, 0, len(data.workouts))
+	for _, wo := range data.workouts {
+		record := WorkoutRecord{Workout: wo}
+		if src := workout.UploadPath(wo.FileURL); src != "" {
+			name := fmt.Sprintf("uploads/%d%s", wo.ID, path.Ext(wo.FileURL))
+			if err := copyFile(zw, name, src); err != nil {
+				if !os.IsNotExist(err) {
+					return err
+				}
+			} else {
+				record.OriginalFile = name
+			}
+		}
+		workouts = append(workouts, record)
+	}
+	if err := writeJSON(zw, "workouts.json", workouts); err != nil {
+		return err
+	}
+	if err := writeCSV(zw, "workouts.csv", workoutRows(workouts)); err != nil {
+		return err
+	}
+
+	if err := writeJSON(zw, "equipment.json", data.equipment); err != nil {
+		return err
+	}
+	if err := writeCSV(zw, "equipment.csv", equipmentRows(data.equipment)); err != nil {
+		return err
+	}
+
+	sessions := make([]SessionRecord, 0, len(data.sessions))
+	for _, s := range data.sessions {
+		sessions = append(sessions, SessionRecord{
+			SessionID:  s.FamilyID,
+			DeviceName: s.DeviceName,
+			UserAgent:  s.UserAgent,
+			IPAddress:  s.IPAddress,
+			CreatedAt:  s.CreatedAt,
+			ExpiresAt:  s.ExpiresAt,
+			RevokedAt:  s.RevokedAt,
+		})
+	}
+	if err := writeJSON(zw, "sessions.json", sessions); err != nil {
+		return err
+	}
+	if err := writeCSV(zw, "sessions.csv", sessionRows(sessions)); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func writeJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func writeCSV(zw *zip.Writer, name string, rows [][]string) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(f)
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+func copyFile(zw *zip.Writer, name, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func accountRows(a Account) [][]string {
+	rows := [][]string{{
+		"id", "username", "email", "email_verified_at", "role", "created_at",
+		"first_name", "last_name", "bio", "resting_hr", "max_hr", "ftp", "weight",
+	}}
+	row := []string{
+		uintString(a.ID), a.Username, a.Email, timePtrString(a.EmailVerifiedAt), a.Role, timeString(a.CreatedAt),
+	}
+	if p := a.Profile; p != nil {
+		row = append(row,
+			p.FirstName, p.LastName, p.Bio,
+			strconv.Itoa(p.RestingHR), strconv.Itoa(p.MaxHR), strconv.Itoa(p.FTP), floatString(p.Weight),
+		)
+	} else {
+		row = append(row, "", "", "", "", "", "", "")
+	}
+	return append(rows, row)
+}
+
+func workoutRows(workouts []WorkoutRecord) [][]string {
+	rows := [][]string{{
+		"id", "title", "description", "type", "status", "scheduled_date", "duration", "distance",
+		"elev_gain", "avg_power", "avg_hr", "max_power", "max_hr", "calories_burned", "file_type",
+		"original_file", "notes", "workout_data", "created_at", "updated_at",
+	}}
+	for _, w := range workouts {
+		workoutData, _ := json.Marshal(w.WorkoutData)
+		rows = append(rows, []string{
+			uintString(w.ID), w.Title, w.Description, w.Type, w.Status, timeString(w.ScheduledDate),
+			strconv.Itoa(w.Duration), floatString(w.Distance), strconv.Itoa(w.ElevGain),
+			strconv.Itoa(w.AvgPower), strconv.Itoa(w.AvgHR), strconv.Itoa(w.MaxPower), strconv.Itoa(w.MaxHR),
+			strconv.Itoa(w.CaloriesBurned), w.FileType, w.OriginalFile, w.Notes, string(workoutData),
+			timeString(w.CreatedAt), timeString(w.UpdatedAt),
+		})
+	}
+	return rows
+}
+
+func equipmentRows(equipment []profile.Equipment) [][]string {
+	rows := [][]string{{
+		"id", "name", "type", "brand", "model", "weight", "notes", "active", "created_at", "updated_at",
+	}}
+	for _, e := range equipment {
+		rows = append(rows, []string{
+			uintString(e.ID), e.Name, e.Type, e.Brand, e.Model, floatString(e.Weight), e.Notes,
+			strconv.FormatBool(e.Active), timeString(e.CreatedAt), timeString(e.UpdatedAt),
+		})
+	}
+	return rows
+}
+
+func sessionRows(sessions []SessionRecord) [][]string {
+	rows := [][]string{{
+		"session_id", "device_name", "user_agent", "ip_address", "created_at", "expires_at", "revoked_at",
+	}}
+	for _, s := range sessions {
+		rows = append(rows, []string{
+			s.SessionID, s.DeviceName, s.UserAgent, s.IPAddress,
+			timeString(s.CreatedAt), timeString(s.ExpiresAt), timePtrString(s.RevokedAt),
+		})
+	}
+	return rows
+}
+
+func uintString(v uint) string {
+	return strconv.FormatUint(uint64(v), 10)
+}
+
+func floatString(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func timeString(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func timePtrString(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return timeString(*t)
+}
@@ -0,0 +1,217 @@
+package takeout
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"rideaware/internal/profile"
+	"rideaware/internal/user"
+	"rideaware/internal/workout"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	workout.SetUploadDir(t.TempDir())
+
+	fitFile := []byte("original FIT bytes")
+	fileURL, err := workout.SaveUpload(7, "ride.fit", fitFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	verified := created.Add(time.Hour)
+	revoked := created.Add(48 * time.Hour)
+	data := &archiveData{
+		manifest: Manifest{
+			Format:     "rideaware-takeout",
+			Version:    FormatVersion,
+			ExportedAt: created.Add(72 * time.Hour),
+			UserID:     7,
+			Username:   "alice",
+		},
+		account: Account{
+			ID:              7,
+			Username:        "alice",
+			Email:           "alice@example.com",
+			EmailVerifiedAt: &verified,
+			Role:            "athlete",
+			CreatedAt:       created,
+			Profile:         &user.Profile{UserID: 7, FirstName: "Alice", FTP: 250, Weight: 61.5},
+		},
+		workouts: []workout.Workout{
+			{ID: 3, UserID: 7, Title: "Sweet spot", Type: "bike", Status: "completed",
+				ScheduledDate: created, Duration: 3600, Distance: 32.4, AvgPower: 210,
+				FileType: "fit", FileURL: fileURL, CreatedAt: created, UpdatedAt: created},
+			{ID: 4, UserID: 7, Title: "Recovery, easy", Notes: "line one\nline two",
+				ScheduledDate: created, CreatedAt: created, UpdatedAt: created},
+		},
+		equipment: []profile.Equipment{
+			{ID: 9, UserID: 7, Name: "Road bike", Type: "bike", Brand: "Canyon", Weight: 7800,
+				Active: true, CreatedAt: created, UpdatedAt: created},
+		},
+		sessions: []user.Session{
+			{UserID: 7, FamilyID: "family-1", DeviceName: "Pixel 8", IPAddress: "192.0.2.1",
+				CreatedAt: created, ExpiresAt: created.Add(30 * 24 * time.Hour), RevokedAt: &revoked},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeArchive(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var manifest Manifest
+	if err := readArchiveJSON(files, "manifest.json", &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(manifest, data.manifest) {
+		t.Errorf("manifest = %+v, want %+v", manifest, data.manifest)
+	}
+
+	var account Account
+	if err := readArchiveJSON(files, "account.json", &account); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(account, data.account) {
+		t.Errorf("account = %+v, want %+v", account, data.account)
+	}
+
+	var equipment []profile.Equipment
+	if err := readArchiveJSON(files, "equipment.json", &equipment); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(equipment, data.equipment) {
+		t.Errorf("equipment = %+v, want %+v", equipment, data.equipment)
+	}
+
+	var workouts []WorkoutRecord
+	if err := readArchiveJSON(files, "workouts.json", &workouts); err != nil {
+		t.Fatal(err)
+	}
+	if len(workouts) != 2 {
+		t.Fatalf("archive has %d workouts, want 2", len(workouts))
+	}
+	for i, record := range workouts {
+		if !reflect.DeepEqual(record.Workout, data.workouts[i]) {
+			t.Errorf("workout %d = %+v, want %+v", i, record.Workout, data.workouts[i])
+		}
+	}
+	if workouts[0].OriginalFile != "uploads/3.fit" || workouts[1].OriginalFile != "" {
+		t.Errorf("original files = %q and %q, want uploads/3.fit and none",
+			workouts[0].OriginalFile, workouts[1].OriginalFile)
+	}
+
+	restored, err := storeArchivedUpload(8, files, workouts[0].OriginalFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(workout.UploadPath(restored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, fitFile) {
+		t.Errorf("restored upload = %q, want %q", content, fitFile)
+	}
+
+	var sessions []SessionRecord
+	if err := readArchiveJSON(files, "sessions.json", &sessions); err != nil {
+		t.Fatal(err)
+	}
+	wantSessions := []SessionRecord{{
+		SessionID: "family-1", DeviceName: "Pixel 8", IPAddress: "192.0.2.1",
+		CreatedAt: created, ExpiresAt: data.sessions[0].ExpiresAt, RevokedAt: &revoked,
+	}}
+	if !reflect.DeepEqual(sessions, wantSessions) {
+		t.Errorf("sessions = %+v, want %+v", sessions, wantSessions)
+	}
+
+	// Every CSV has a header and one row per record, even with commas and
+	// newlines in the values
+	for name, want := range map[string]int{
+		"account.csv": 1, "workouts.csv": 2, "equipment.csv": 1, "sessions.csv": 1,
+	} {
+		content, err := readArchiveFile(files, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(rows) != want+1 {
+			t.Errorf("%s has %d rows, want %d and a header", name, len(rows)-1, want)
+		}
+	}
+}
+
+func TestImportArchiveRejectsInvalidArchives(t *testing.T) {
+	archive := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, content := range files {
+			f, err := zw.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte(content))
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name    string
+		archive []byte
+		want    string
+	}{
+		{"not a zip", []byte("plain text"), "not a zip archive"},
+		{"no manifest", archive(map[string]string{"account.json": "{}"}), "missing manifest.json"},
+		{"invalid manifest", archive(map[string]string{"manifest.json": "{"}), "manifest.json is not valid"},
+		{"other format", archive(map[string]string{
+			"manifest.json": `{"format":"other","version":1}`,
+		}), "not a RideAware takeout"},
+		{"newer version", archive(map[string]string{
+			"manifest.json": `{"format":"rideaware-takeout","version":99}`,
+		}), "unsupported takeout format version 99"},
+		{"no account", archive(map[string]string{
+			"manifest.json": `{"format":"rideaware-takeout","version":1}`,
+		}), "missing account.json"},
+	}
+
+	s := &Service{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.ImportArchive(7, bytes.NewReader(tt.archive), int64(len(tt.archive)))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ImportArchive = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreArchivedUploadRejectsOtherPaths(t *testing.T) {
+	workout.SetUploadDir(t.TempDir())
+
+	for _, name := range []string{"manifest.json", "uploads/../manifest.json", "../uploads/1.fit"} {
+		if _, err := storeArchivedUpload(7, map[string]*zip.File{}, name); err == nil {
+			t.Errorf("storeArchivedUpload accepted %q", name)
+		}
+	}
+}
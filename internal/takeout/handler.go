@@ -0,0 +1,161 @@
+package takeout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"rideaware/internal/config"
+	"rideaware/internal/middleware"
+)
+
+// maxImportSize caps the size of an uploaded takeout archive.
+const maxImportSize = 512 << 20
+
+// transferTimeout replaces the server's read and write timeouts for archive
+// uploads and downloads, which can take far longer than an API call.
+const transferTimeout = 30 * time.Minute
+
+type Handler struct {
+	service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{
+		service: service,
+	}
+}
+
+type ExportResponse struct {
+	ID          uint       `json:"id"`
+	Status      string     `json:"status"`
+	Size        int64      `json:"size"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	DownloadURL string     `json:"download_url,omitempty"`
+}
+
+// RequestExport POST /api/protected/takeout
+func (h *Handler) RequestExport(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	export, err := h.service.RequestExport(claims.UserID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(toResponse(export))
+}
+
+// GetExports GET /api/protected/takeout
+func (h *Handler) GetExports(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	exports, err := h.service.GetUserExports(claims.UserID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch exports"})
+		return
+	}
+
+	resp := make([]ExportResponse, 0, len(exports))
+	for i := range exports {
+		resp = append(resp, toResponse(&exports[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ImportArchive POST /api/protected/takeout/import
+func (h *Handler) ImportArchive(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(transferTimeout))
+	rc.SetWriteDeadline(time.Now().Add(transferTimeout))
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		w.Header().Set("Content-Type", "application/json")
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(map[string]string{"error": "file too large"})
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid form"})
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("archive")
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no archive provided"})
+		return
+	}
+	defer file.Close()
+
+	report, err := h.service.ImportArchive(claims.UserID, file, header.Size)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Download GET /api/takeout/download?token=
+//
+// The token in the link is the credential, so the archive can be fetched by
+// a browser without an Authorization header.
+func (h *Handler) Download(w http.ResponseWriter, r *http.Request) {
+	export, f, err := h.service.OpenDownload(r.URL.Query().Get("token"))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "download link is invalid or has expired"})
+		return
+	}
+	defer f.Close()
+
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(transferTimeout))
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="rideaware-takeout-%d.zip"`, export.ID))
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, "", *export.CompletedAt, f)
+}
+
+func toResponse(export *Export) ExportResponse {
+	resp := ExportResponse{
+		ID:          export.ID,
+		Status:      export.Status,
+		Size:        export.Size,
+		Error:       export.Error,
+		CreatedAt:   export.CreatedAt,
+		CompletedAt: export.CompletedAt,
+		ExpiresAt:   export.ExpiresAt,
+	}
+	if export.IsDownloadable() {
+		resp.DownloadURL = "/api/takeout/download?token=" + url.QueryEscape(export.Token)
+	}
+	return resp
+}
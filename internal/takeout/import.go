@@ -0,0 +1,318 @@
+package takeout
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"rideaware/internal/profile"
+	"rideaware/internal/user"
+	"rideaware/internal/workout"
+)
+
+// maxArchiveEntrySize caps how much is read from a single file in an
+// imported archive, so a crafted archive cannot exhaust memory.
+const maxArchiveEntrySize = 50 << 20
+
+// ImportReport describes the outcome of an import. IDMap maps the IDs in the
+// archive to the IDs of the records created for them.
+type ImportReport struct {
+	ProfileFields []string             `json:"profile_fields"`
+	Workouts      ImportCounts         `json:"workouts"`
+	Equipment     ImportCounts         `json:"equipment"`
+	IDMap         ImportIDMap          `json:"id_map"`
+	Conflicts     []ImportRecordResult `json:"conflicts"`
+	Skipped       []ImportRecordResult `json:"skipped"`
+}
+
+type ImportCounts struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+type ImportIDMap struct {
+	Workouts  map[uint]uint `json:"workouts"`
+	Equipment map[uint]uint `json:"equipment"`
+}
+
+// ImportRecordResult explains why a record was not imported as is.
+type ImportRecordResult struct {
+	Type     string `json:"type"`
+	SourceID uint   `json:"source_id,omitempty"`
+	Field    string `json:"field,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// ImportArchive recreates the profile settings, equipment and workouts of a
+// takeout archive under userID. Records that already exist or cannot be
+// imported are reported and skipped rather than failing the import; only an
+// unreadable archive is an error.
+func (s *Service) ImportArchive(userID uint, r io.ReaderAt, size int64) (*ImportReport, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, errors.New("file is not a zip archive")
+	}
+
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var manifest Manifest
+	if err := readArchiveJSON(files, "manifest.json", &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Format != "rideaware-takeout" {
+		return nil, errors.New("archive is not a RideAware takeout")
+	}
+	if manifest.Version < 1 || manifest.Version > FormatVersion {
+		return nil, fmt.Errorf("unsupported takeout format version %d", manifest.Version)
+	}
+
+	var account Account
+	if err := readArchiveJSON(files, "account.json", &account); err != nil {
+		return nil, err
+	}
+	var equipment []profile.Equipment
+	if err := readArchiveJSON(files, "equipment.json", &equipment); err != nil {
+		return nil, err
+	}
+	var workouts []WorkoutRecord
+	if err := readArchiveJSON(files, "workouts.json", &workouts); err != nil {
+		return nil, err
+	}
+
+	target, err := s.users.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{
+		ProfileFields: []string{},
+		IDMap: ImportIDMap{
+			Workouts:  map[uint]uint{},
+			Equipment: map[uint]uint{},
+		},
+		Conflicts: []ImportRecordResult{},
+		Skipped:   []ImportRecordResult{},
+	}
+
+	if account.Profile != nil && target.Profile != nil {
+		if err := s.importProfile(target.Profile, account.Profile, report); err != nil {
+			return nil, err
+		}
+	}
+	s.importEquipment(userID, equipment, report)
+	s.importWorkouts(userID, workouts, files, report)
+
+	return report, nil
+}
+
+// importProfile copies profile settings into empty fields of the target
+// profile. Fields the user already filled in differently are reported as
+// conflicts and left alone. Totals are derived from workouts and are not
+// copied.
+func (s *Service) importProfile(target, source *user.Profile, report *ImportReport) error {
+	updates := map[string]interface{}{}
+	merge := func(field string, targetEmpty, equal bool, value interface{}) {
+		switch {
+		case equal:
+		case targetEmpty:
+			updates[field] = value
+			report.ProfileFields = append(report.ProfileFields, field)
+		default:
+			report.Conflicts = append(report.Conflicts, ImportRecordResult{
+				Type:   "profile",
+				Field:  field,
+				Reason: "already set to a different value",
+			})
+		}
+	}
+
+	if source.FirstName != "" {
+		merge("first_name", target.FirstName == "", target.FirstName == source.FirstName, source.FirstName)
+	}
+	if source.LastName != "" {
+		merge("last_name", target.LastName == "", target.LastName == source.LastName, source.LastName)
+	}
+	if source.Bio != "" {
+		merge("bio", target.Bio == "", target.Bio == source.Bio, source.Bio)
+	}
+	if source.RestingHR > 0 {
+		merge("resting_hr", target.RestingHR == 0, target.RestingHR == source.RestingHR, source.RestingHR)
+	}
+	if source.MaxHR > 0 {
+		merge("max_hr", target.MaxHR == 0, target.MaxHR == source.MaxHR, source.MaxHR)
+	}
+	if source.FTP > 0 {
+		merge("ftp", target.FTP == 0, target.FTP == source.FTP, source.FTP)
+	}
+	if source.Weight > 0 {
+		merge("weight", target.Weight == 0, target.Weight == source.Weight, source.Weight)
+	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+	return s.repo.UpdateProfileFields(target.UserID, updates)
+}
+
+// importEquipment creates the archived equipment. An item with the same name
+// and type as one the user already has is treated as the same item.
+func (s *Service) importEquipment(userID uint, items []profile.Equipment, report *ImportReport) {
+	existing, err := s.repo.GetUserEquipment(userID)
+	if err != nil {
+		existing = nil
+	}
+
+	for _, item := range items {
+		sourceID := item.ID
+		if strings.TrimSpace(item.Name) == "" || strings.TrimSpace(item.Type) == "" {
+			report.Equipment.Skipped++
+			report.Skipped = append(report.Skipped, ImportRecordResult{
+				Type: "equipment", SourceID: sourceID, Reason: "name and type are required",
+			})
+			continue
+		}
+
+		if match := findEquipment(existing, item.Name, item.Type); match != nil {
+			report.Equipment.Skipped++
+			report.IDMap.Equipment[sourceID] = match.ID
+			report.Conflicts = append(report.Conflicts, ImportRecordResult{
+				Type: "equipment", SourceID: sourceID, Reason: "equipment with the same name and type already exists",
+			})
+			continue
+		}
+
+		item.ID = 0
+		item.UserID = userID
+		if err := s.repo.CreateEquipment(&item); err != nil {
+			report.Equipment.Skipped++
+			report.Skipped = append(report.Skipped, ImportRecordResult{
+				Type: "equipment", SourceID: sourceID, Reason: "failed to save",
+			})
+			continue
+		}
+
+		existing = append(existing, item)
+		report.Equipment.Imported++
+		report.IDMap.Equipment[sourceID] = item.ID
+	}
+}
+
+// importWorkouts creates the archived workouts together with their original
+// files. A workout with the same title on the same date as an existing one is
+// treated as a duplicate, which makes importing the same archive twice safe.
+func (s *Service) importWorkouts(userID uint, records []WorkoutRecord, files map[string]*zip.File, report *ImportReport) {
+	for _, record := range records {
+		wo := record.Workout
+		sourceID := wo.ID
+
+		if strings.TrimSpace(wo.Title) == "" {
+			report.Workouts.Skipped++
+			report.Skipped = append(report.Skipped, ImportRecordResult{
+				Type: "workout", SourceID: sourceID, Reason: "title is required",
+			})
+			continue
+		}
+
+		if match, err := s.repo.FindWorkout(userID, wo.Title, wo.ScheduledDate); err == nil && match != nil {
+			report.Workouts.Skipped++
+			report.IDMap.Workouts[sourceID] = match.ID
+			report.Conflicts = append(report.Conflicts, ImportRecordResult{
+				Type: "workout", SourceID: sourceID, Reason: "a workout with the same title and date already exists",
+			})
+			continue
+		}
+
+		wo.ID = 0
+		wo.UserID = userID
+		wo.FileURL = ""
+
+		if record.OriginalFile != "" {
+			fileURL, err := storeArchivedUpload(userID, files, record.OriginalFile)
+			if err != nil {
+				report.Skipped = append(report.Skipped, ImportRecordResult{
+					Type: "workout_file", SourceID: sourceID, Reason: err.Error(),
+				})
+			}
+			wo.FileURL = fileURL
+		}
+
+		if err := s.workouts.CreateWorkout(&wo); err != nil {
+			if stored := workout.UploadPath(wo.FileURL); stored != "" {
+				os.Remove(stored)
+			}
+			report.Workouts.Skipped++
+			report.Skipped = append(report.Skipped, ImportRecordResult{
+				Type: "workout", SourceID: sourceID, Reason: "failed to save",
+			})
+			continue
+		}
+
+		report.Workouts.Imported++
+		report.IDMap.Workouts[sourceID] = wo.ID
+	}
+}
+
+// storeArchivedUpload copies an original workout file out of the archive
+// into the user's uploads.
+func storeArchivedUpload(userID uint, files map[string]*zip.File, name string) (string, error) {
+	if !strings.HasPrefix(name, "uploads/") || strings.Contains(name, "..") {
+		return "", errors.New("invalid file path")
+	}
+
+	content, err := readArchiveFile(files, name)
+	if err != nil {
+		return "", err
+	}
+
+	return workout.SaveUpload(userID, path.Base(name), content)
+}
+
+func readArchiveJSON(files map[string]*zip.File, name string, v interface{}) error {
+	content, err := readArchiveFile(files, name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("%s is not valid: %w", name, err)
+	}
+	return nil
+}
+
+func readArchiveFile(files map[string]*zip.File, name string) ([]byte, error) {
+	f, ok := files[name]
+	if !ok {
+		return nil, fmt.Errorf("archive is missing %s", name)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	defer rc.Close()
+
+	content, err := io.ReadAll(io.LimitReader(rc, maxArchiveEntrySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if len(content) > maxArchiveEntrySize {
+		return nil, fmt.Errorf("%s is too large", name)
+	}
+	return content, nil
+}
+
+func findEquipment(items []profile.Equipment, name, kind string) *profile.Equipment {
+	for i := range items {
+		if strings.EqualFold(items[i].Name, name) && strings.EqualFold(items[i].Type, kind) {
+			return &items[i]
+		}
+	}
+	return nil
+}
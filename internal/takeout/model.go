@@ -0,0 +1,36 @@
+package takeout
+
+import "time"
+
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusReady   = "ready"
+	StatusFailed  = "failed"
+	StatusExpired = "expired"
+)
+
+// Export is a requested takeout archive. It is built in the background and
+// can be downloaded with Token until ExpiresAt.
+type Export struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	UserID      uint       `gorm:"not null;index" json:"user_id"`
+	Status      string     `gorm:"not null;index;default:pending" json:"status"`
+	Token       string     `gorm:"uniqueIndex;not null" json:"-"`
+	FilePath    string     `gorm:"default:''" json:"-"`
+	Size        int64      `gorm:"default:0" json:"size"`
+	Error       string     `gorm:"default:''" json:"error,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+func (Export) TableName() string {
+	return "takeout_exports"
+}
+
+// IsDownloadable checks if the archive is built and its link has not expired
+func (e *Export) IsDownloadable() bool {
+	return e.Status == StatusReady && e.ExpiresAt != nil && time.Now().Before(*e.ExpiresAt)
+}
@@ -0,0 +1,168 @@
+package takeout
+
+import (
+	"errors"
+	"time"
+
+	"rideaware/internal/profile"
+	"rideaware/internal/user"
+	"rideaware/internal/workout"
+
+	"gorm.io/gorm"
+)
+
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{db: db}
+}
+
+func (r *Repository) CreateExport(export *Export) error {
+	return r.db.Create(export).Error
+}
+
+// HasActiveExport reports whether the user has an export waiting to be built.
+func (r *Repository) HasActiveExport(userID uint) (bool, error) {
+	var count int64
+	err := r.db.Model(&Export{}).
+		Where("user_id = ? AND status IN ?", userID, []string{StatusPending, StatusRunning}).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (r *Repository) GetUserExports(userID uint) ([]Export, error) {
+	var exports []Export
+	if err := r.db.Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Find(&exports).Error; err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (r *Repository) GetExportByToken(token string) (*Export, error) {
+	var export Export
+	if err := r.db.Where("token = ?", token).First(&export).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("export not found")
+		}
+		return nil, err
+	}
+	return &export, nil
+}
+
+// ClaimPendingExport marks the oldest pending export as running and returns
+// it, or nil when there is none. SKIP LOCKED lets several workers share the
+// queue without building the same export twice.
+func (r *Repository) ClaimPendingExport() (*Export, error) {
+	var exports []Export
+	err := r.db.Raw(`
+		UPDATE takeout_exports SET status = ?, updated_at = ?
+		WHERE id = (
+			SELECT id FROM takeout_exports
+			WHERE status = ?
+			ORDER BY created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		StatusRunning, time.Now(), StatusPending,
+	).Scan(&exports).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(exports) == 0 {
+		return nil, nil
+	}
+	return &exports[0], nil
+}
+
+// RequeueStaleExports puts exports back in the queue whose worker stopped
+// before finishing them.
+func (r *Repository) RequeueStaleExports(olderThan time.Duration) error {
+	return r.db.Model(&Export{}).
+		Where("status = ? AND updated_at < ?", StatusRunning, time.Now().Add(-olderThan)).
+		Update("status", StatusPending).Error
+}
+
+func (r *Repository) MarkExportReady(id uint, path string, size int64, expiresAt time.Time) error {
+	now := time.Now()
+	return r.db.Model(&Export{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":       StatusReady,
+		"file_path":    path,
+		"size":         size,
+		"expires_at":   expiresAt,
+		"completed_at": now,
+	}).Error
+}
+
+func (r *Repository) MarkExportFailed(id uint, message string) error {
+	now := time.Now()
+	return r.db.Model(&Export{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":       StatusFailed,
+		"error":        message,
+		"completed_at": now,
+	}).Error
+}
+
+// GetExpiredExports returns ready exports whose download link has expired.
+func (r *Repository) GetExpiredExports(now time.Time) ([]Export, error) {
+	var exports []Export
+	if err := r.db.Where("status = ? AND expires_at <= ?", StatusReady, now).
+		Find(&exports).Error; err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (r *Repository) MarkExportExpired(id uint) error {
+	return r.db.Model(&Export{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":    StatusExpired,
+		"file_path": "",
+	}).Error
+}
+
+func (r *Repository) GetUserEquipment(userID uint) ([]profile.Equipment, error) {
+	var equipment []profile.Equipment
+	if err := r.db.Where("user_id = ?", userID).
+		Order("id").
+		Find(&equipment).Error; err != nil {
+		return nil, err
+	}
+	return equipment, nil
+}
+
+func (r *Repository) CreateEquipment(equipment *profile.Equipment) error {
+	return r.db.Create(equipment).Error
+}
+
+// FindWorkout returns the user's workout with the given title on the given
+// date, or nil if there is none.
+func (r *Repository) FindWorkout(userID uint, title string, scheduledDate time.Time) (*workout.Workout, error) {
+	var workouts []workout.Workout
+	if err := r.db.Where("user_id = ? AND title = ? AND scheduled_date = ?", userID, title, scheduledDate).
+		Limit(1).
+		Find(&workouts).Error; err != nil {
+		return nil, err
+	}
+	if len(workouts) == 0 {
+		return nil, nil
+	}
+	return &workouts[0], nil
+}
+
+func (r *Repository) UpdateProfileFields(userID uint, updates map[string]interface{}) error {
+	return r.db.Model(&user.Profile{}).Where("user_id = ?", userID).Updates(updates).Error
+}
+
+func (r *Repository) GetUserSessions(userID uint) ([]user.Session, error) {
+	var sessions []user.Session
+	if err := r.db.Where("user_id = ?", userID).
+		Order("created_at").
+		Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
@@ -0,0 +1,198 @@
+package takeout
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"rideaware/internal/email"
+	"rideaware/internal/user"
+	"rideaware/internal/workout"
+
+	"gorm.io/gorm"
+)
+
+// downloadLinkDuration is how long a finished archive can be downloaded.
+const downloadLinkDuration = 7 * 24 * time.Hour
+
+// exportDir is where finished archives are kept until their link expires.
+var exportDir = "exports"
+
+// SetExportDir configures where takeout archives are written. An empty value
+// keeps the default.
+func SetExportDir(dir string) {
+	if dir != "" {
+		exportDir = dir
+	}
+}
+
+// RemoveUserExports deletes every archive built for the user.
+func RemoveUserExports(userID uint) error {
+	return os.RemoveAll(filepath.Join(exportDir, fmt.Sprint(userID)))
+}
+
+type Service struct {
+	repo     *Repository
+	users    *user.Repository
+	workouts *workout.Repository
+	email    *email.Service
+}
+
+func NewService(db *gorm.DB, mailer *email.Service) *Service {
+	return &Service{
+		repo:     NewRepository(db),
+		users:    user.NewRepository(db),
+		workouts: workout.NewRepository(db),
+		email:    mailer,
+	}
+}
+
+// RequestExport queues a new archive for the user. Only one export can be in
+// progress at a time.
+func (s *Service) RequestExport(userID uint) (*Export, error) {
+	active, err := s.repo.HasActiveExport(userID)
+	if err != nil {
+		return nil, err
+	}
+	if active {
+		return nil, errors.New("an export is already in progress")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	export := &Export{
+		UserID: userID,
+		Status: StatusPending,
+		Token:  base64.RawURLEncoding.EncodeToString(b),
+	}
+	if err := s.repo.CreateExport(export); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+func (s *Service) GetUserExports(userID uint) ([]Export, error) {
+	return s.repo.GetUserExports(userID)
+}
+
+// OpenDownload returns the archive behind a download token. The caller must
+// close the file.
+func (s *Service) OpenDownload(token string) (*Export, *os.File, error) {
+	export, err := s.repo.GetExportByToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !export.IsDownloadable() {
+		return nil, nil, errors.New("download link has expired")
+	}
+
+	f, err := os.Open(export.FilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return export, f, nil
+}
+
+// buildExport writes the archive for export and records the outcome. The
+// user is emailed the download link once it is ready.
+func (s *Service) buildExport(export *Export) error {
+	u, err := s.users.GetUserByID(export.UserID)
+	if err != nil {
+		return err
+	}
+
+	data := &archiveData{
+		manifest: Manifest{
+			Format:     "rideaware-takeout",
+			Version:    FormatVersion,
+			ExportedAt: time.Now().UTC(),
+			UserID:     u.ID,
+			Username:   u.Username,
+		},
+		account: Account{
+			ID:              u.ID,
+			Username:        u.Username,
+			Email:           u.Email,
+			EmailVerifiedAt: u.EmailVerifiedAt,
+			Role:            u.Role,
+			CreatedAt:       u.CreatedAt,
+			Profile:         u.Profile,
+		},
+	}
+	if data.workouts, err = s.workouts.GetUserWorkouts(u.ID); err != nil {
+		return err
+	}
+	if data.equipment, err = s.repo.GetUserEquipment(u.ID); err != nil {
+		return err
+	}
+	if data.sessions, err = s.repo.GetUserSessions(u.ID); err != nil {
+		return err
+	}
+
+	path := filepath.Join(exportDir, fmt.Sprint(u.ID), fmt.Sprintf("%d.zip", export.ID))
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	if err := writeArchive(f, data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(downloadLinkDuration)
+	if err := s.repo.MarkExportReady(export.ID, path, info.Size(), expiresAt); err != nil {
+		return err
+	}
+
+	// The archive holds everything about the account, so the link is only
+	// mailed to an address the user proved they own.
+	if u.IsEmailVerified() {
+		downloadLink := "https://rideaware.app/takeout?token=" + export.Token
+		if err := s.email.SendTakeoutReadyEmail(u.Email, u.Username, downloadLink, expiresAt); err != nil {
+			log.Printf("Failed to send takeout email to user %d: %v", u.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// expireExports deletes archives whose download link has expired.
+func (s *Service) expireExports() error {
+	exports, err := s.repo.GetExpiredExports(time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, export := range exports {
+		if err := os.Remove(export.FilePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove takeout %d: %v", export.ID, err)
+			continue
+		}
+		if err := s.repo.MarkExportExpired(export.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
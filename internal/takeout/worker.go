@@ -0,0 +1,68 @@
+package takeout
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// staleExportAfter is how long an export may stay running before it is
+// assumed its worker died and it is queued again.
+const staleExportAfter = time.Hour
+
+// Worker builds queued exports in the background.
+type Worker struct {
+	service *Service
+}
+
+func NewWorker(service *Service) *Worker {
+	return &Worker{
+		service: service,
+	}
+}
+
+// Run processes the export queue every interval until ctx is cancelled.
+func (w *Worker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		w.processQueue(ctx)
+
+		if err := w.service.expireExports(); err != nil {
+			log.Printf("Failed to expire takeout exports: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processQueue builds pending exports one after another until the queue is
+// empty.
+func (w *Worker) processQueue(ctx context.Context) {
+	if err := w.service.repo.RequeueStaleExports(staleExportAfter); err != nil {
+		log.Printf("Failed to requeue stale takeout exports: %v", err)
+	}
+
+	for ctx.Err() == nil {
+		export, err := w.service.repo.ClaimPendingExport()
+		if err != nil {
+			log.Printf("Failed to claim takeout export: %v", err)
+			return
+		}
+		if export == nil {
+			return
+		}
+
+		if err := w.service.buildExport(export); err != nil {
+			log.Printf("Takeout export %d failed: %v", export.ID, err)
+			if err := w.service.repo.MarkExportFailed(export.ID, "failed to build archive"); err != nil {
+				log.Printf("Failed to record takeout failure %d: %v", export.ID, err)
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package user
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"rideaware/internal/config"
 	"rideaware/internal/middleware"
@@ -12,9 +13,9 @@ type Handler struct {
 	service *Service
 }
 
-func NewHandler() *Handler {
+func NewHandler(service *Service) *Handler {
 	return &Handler{
-		service: NewService(),
+		service: service,
 	}
 }
 
@@ -60,34 +61,310 @@ func (h *Handler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := h.service.repo.GetUserByID(claims.UserID)
+	user, err := h.service.UpdateProfile(r.Context(), claims.UserID, ProfileUpdate{
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Bio:       req.Bio,
+		FTP:       req.FTP,
+		MaxHR:     req.MaxHR,
+		Weight:    req.Weight,
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		message := "failed to update profile"
+		if err.Error() == "user not found" {
+			status = http.StatusNotFound
+			message = "user not found"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": message})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetProfileResponse{
+		User:    user,
+		Profile: user.Profile,
+	})
+}
+
+type SessionResponse struct {
+	ID           string    `json:"id"`
+	DeviceName   string    `json:"device_name"`
+	UserAgent    string    `json:"user_agent"`
+	IPAddress    string    `json:"ip_address"`
+	LastActiveAt time.Time `json:"last_active_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Current      bool      `json:"current"`
+}
+
+// GetSessions GET /api/protected/sessions
+func (h *Handler) GetSessions(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	sessions, err := h.service.GetActiveSessions(claims.UserID)
 	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch sessions"})
+		return
+	}
+
+	resp := make([]SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		resp = append(resp, SessionResponse{
+			ID:           session.FamilyID,
+			DeviceName:   session.DeviceName,
+			UserAgent:    session.UserAgent,
+			IPAddress:    session.IPAddress,
+			LastActiveAt: session.CreatedAt,
+			ExpiresAt:    session.ExpiresAt,
+			Current:      session.FamilyID == claims.SessionID,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// RevokeSession DELETE /api/protected/sessions?id=
+func (h *Handler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid session id"})
+		return
+	}
+
+	if err := h.service.RevokeSession(r.Context(), claims.UserID, id); err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "user not found"})
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EnrollTOTP POST /api/protected/mfa/totp
+func (h *Handler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	secret, uri, err := h.service.EnrollTOTP(claims.UserID)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": uri,
+	})
+}
+
+// ConfirmTOTP POST /api/protected/mfa/totp/confirm
+func (h *Handler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	codes, err := h.service.ConfirmTOTP(r.Context(), claims.UserID, req.Code)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// DisableTOTP DELETE /api/protected/mfa/totp
+func (h *Handler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
 		return
 	}
 
-	// Update profile
-	if user.Profile != nil {
-		user.Profile.FirstName = req.FirstName
-		user.Profile.LastName = req.LastName
-		user.Profile.Bio = req.Bio
-		user.Profile.FTP = req.FTP
-		user.Profile.MaxHR = req.MaxHR
-		user.Profile.Weight = req.Weight
+	if err := h.service.DisableTOTP(r.Context(), claims.UserID, req.Password); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
 
-		if err := h.service.repo.UpdateUser(user); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "failed to update profile"})
-			return
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes POST /api/protected/mfa/recovery-codes
+func (h *Handler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	codes, err := h.service.RegenerateRecoveryCodes(r.Context(), claims.UserID, req.Code)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// SetUserRole PUT /api/admin/users/role
+func (h *Handler) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	var req struct {
+		UserID      uint     `json:"user_id"`
+		Role        string   `json:"role"`
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	u, err := h.service.SetUserRole(r.Context(), claims.UserID, req.UserID, req.Role, req.Permissions)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err.Error() == "user not found" {
+			status = http.StatusNotFound
 		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(GetProfileResponse{
-		User:    user,
-		Profile: user.Profile,
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":     u.ID,
+		"role":        u.Role,
+		"permissions": u.PermissionList(),
 	})
-}
\ No newline at end of file
+}
+
+// Impersonate POST /api/admin/users/impersonate
+func (h *Handler) Impersonate(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	var req struct {
+		UserID uint `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	u, err := h.service.Impersonate(r.Context(), claims.UserID, req.UserID)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err.Error() == "user not found" {
+			status = http.StatusNotFound
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// The token shares the admin's session so signing the admin out ends
+	// the impersonation too
+	accessToken, err := config.GenerateImpersonationToken(config.CustomClaims{
+		UserID:         u.ID,
+		Email:          u.Email,
+		EmailVerified:  u.IsEmailVerified(),
+		Username:       u.Username,
+		Role:           u.Role,
+		Permissions:    u.PermissionList(),
+		SessionID:      claims.SessionID,
+		ImpersonatorID: claims.UserID,
+	})
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to issue token"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(config.JWT.ImpersonationDuration.Seconds()),
+		"user_id":      u.ID,
+		"username":     u.Username,
+	})
+}
+
+// DeleteAccount DELETE /api/protected/account
+func (h *Handler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	u, err := h.service.ScheduleDeletion(r.Context(), claims.UserID, req.Password)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":                "Account scheduled for deletion",
+		"deletion_scheduled_for": u.DeletionScheduledFor,
+	})
+}
@@ -1,10 +1,13 @@
 package user
 
 import (
-	"errors"
+	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"rideaware/internal/passwordpolicy"
+	"rideaware/internal/rbac"
+	"rideaware/pkg/passwordhash"
+
 	"gorm.io/gorm"
 )
 
@@ -17,9 +20,30 @@ type User struct {
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
-	Profile        *Profile         `gorm:"foreignKey:UserID;constraint:OnDelete:Cascade" json:"profile,omitempty"`
-	PasswordResets []PasswordReset  `gorm:"foreignKey:UserID;constraint:OnDelete:Cascade" json:"password_resets,omitempty"`
-	Sessions       []Session        `gorm:"foreignKey:UserID;constraint:OnDelete:Cascade" json:"sessions,omitempty"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+
+	// Role is one of the rbac roles. Permissions lists extra rbac permissions
+	// granted on top of the role, space separated.
+	Role        string `gorm:"not null;default:athlete" json:"role"`
+	Permissions string `gorm:"not null;default:''" json:"-"`
+
+	// DeletionScheduledFor is set while a requested account deletion can
+	// still be undone. The account is purged once it has passed.
+	DeletionScheduledFor *time.Time `gorm:"index" json:"deletion_scheduled_for,omitempty"`
+
+	// TOTPSecret holds the pending secret during enrollment and the active
+	// one once TOTPEnabledAt is set. TOTPLastStep is the last accepted time
+	// step, which stops a code from being replayed.
+	TOTPSecret    string     `gorm:"default:''" json:"-"`
+	TOTPEnabledAt *time.Time `json:"totp_enabled_at"`
+	TOTPLastStep  int64      `gorm:"default:0" json:"-"`
+
+	Profile        *Profile        `gorm:"foreignKey:UserID;constraint:OnDelete:Cascade" json:"profile,omitempty"`
+	PasswordResets []PasswordReset `gorm:"foreignKey:UserID;constraint:OnDelete:Cascade" json:"password_resets,omitempty"`
+	Sessions       []Session       `gorm:"foreignKey:UserID;constraint:OnDelete:Cascade" json:"sessions,omitempty"`
+	ActionTokens   []ActionToken   `gorm:"foreignKey:UserID;constraint:OnDelete:Cascade" json:"action_tokens,omitempty"`
+	RecoveryCodes  []RecoveryCode  `gorm:"foreignKey:UserID;constraint:OnDelete:Cascade" json:"-"`
+	Identities     []Identity      `gorm:"foreignKey:UserID;constraint:OnDelete:Cascade" json:"identities,omitempty"`
 }
 
 type Profile struct {
@@ -49,41 +73,114 @@ type PasswordReset struct {
 	CreatedAt time.Time  `json:"created_at"`
 }
 
+// Session records one refresh token. Every rotation marks the current row as
+// rotated and inserts a new one carrying the same FamilyID, so a family is the
+// chain of refresh tokens descending from a single login. Families started by
+// an OAuth2 authorization belong to ClientID and are limited to Scopes.
 type Session struct {
-	ID         uint      `gorm:"primaryKey" json:"id"`
-	UserID     uint      `gorm:"not null;index" json:"user_id"`
-	Token      string    `gorm:"uniqueIndex;not null" json:"token"`
-	ExpiresAt  time.Time `gorm:"not null;index" json:"expires_at"`
-	DeviceName string    `gorm:"default:''" json:"device_name"`
-	UserAgent  string    `gorm:"default:''" json:"user_agent"`
-	IPAddress  string    `gorm:"default:''" json:"ip_address"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	Token      string     `gorm:"uniqueIndex;not null" json:"-"` // refresh token jti
+	FamilyID   string     `gorm:"not null;index" json:"-"`
+	ExpiresAt  time.Time  `gorm:"not null;index" json:"expires_at"`
+	DeviceName string     `gorm:"default:''" json:"device_name"`
+	UserAgent  string     `gorm:"default:''" json:"user_agent"`
+	IPAddress  string     `gorm:"default:''" json:"ip_address"`
+	RotatedAt  *time.Time `json:"rotated_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	ClientID   string     `gorm:"default:'';index" json:"client_id,omitempty"`
+	Scopes     string     `gorm:"default:''" json:"-"` // space separated
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// ActionToken is a single-use token emailed to a user to authorise one
+// account action, such as unlocking the account. Data carries any value the
+// action needs.
+type ActionToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	Purpose   string     `gorm:"not null;index" json:"purpose"`
+	Token     string     `gorm:"uniqueIndex;not null" json:"-"`
+	Data      string     `gorm:"default:''" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// RecoveryCode is a single-use second factor for users who lost their
+// authenticator. Only the SHA-256 hash of the code is stored.
+type RecoveryCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"uniqueIndex;not null" json:"-"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Identity links a user to their account at an external OAuth2/OIDC provider.
+type Identity struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	Provider  string    `gorm:"not null;uniqueIndex:idx_identity_provider_subject" json:"provider"`
+	Subject   string    `gorm:"not null;uniqueIndex:idx_identity_provider_subject" json:"-"`
+	Email     string    `gorm:"default:''" json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LoginThrottle counts recent failed logins for one key, either
+// "user:<username>" or "ip:<address>".
+type LoginThrottle struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	Key           string     `gorm:"uniqueIndex;not null" json:"key"`
+	Failures      int        `gorm:"not null;default:0" json:"failures"`
+	LastFailureAt time.Time  `gorm:"not null" json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+	UpdatedAt     time.Time  `json:"updated_at"`
 }
 
+const (
+	ActionUnlockAccount = "unlock_account"
+	ActionVerifyEmail   = "verify_email"
+	ActionUndoDeletion  = "undo_deletion"
+	ActionChangeEmail   = "change_email"
+	ActionRevertEmail   = "revert_email"
+	ActionMagicLink     = "magic_link"
+)
+
 // ===== Methods =====
 
-// SetPassword hashes and sets the password
+// SetPassword checks the password against the password policy, then hashes
+// and sets it
 func (u *User) SetPassword(rawPassword string) error {
-	if len(rawPassword) < 8 {
-		return errors.New("password must be at least 8 characters long")
+	if err := passwordpolicy.Check(rawPassword, u.Username, u.Email); err != nil {
+		return err
 	}
-	hashedPassword, err := bcrypt.GenerateFromPassword(
-		[]byte(rawPassword),
-		bcrypt.DefaultCost,
-	)
+	hashedPassword, err := passwordhash.Hash(rawPassword)
 	if err != nil {
 		return err
 	}
-	u.Password = string(hashedPassword)
+	u.Password = hashedPassword
 	return nil
 }
 
-// CheckPassword verifies the password
-func (u *User) CheckPassword(password string) bool {
-	return bcrypt.CompareHashAndPassword(
-		[]byte(u.Password),
-		[]byte(password),
-	) == nil
+// CheckPassword verifies the password. When it matches a hash made with
+// bcrypt or outdated argon2id parameters, Password is replaced by a current
+// hash and upgraded is true so the caller can persist it.
+func (u *User) CheckPassword(password string) (ok bool, upgraded bool) {
+	ok, needsRehash, err := passwordhash.Verify(password, u.Password)
+	if err != nil || !ok {
+		return false, false
+	}
+	if !needsRehash {
+		return true, false
+	}
+
+	hashedPassword, err := passwordhash.Hash(password)
+	if err != nil {
+		return true, false
+	}
+	u.Password = hashedPassword
+	return true, true
 }
 
 // AfterCreate hook: automatically create profile after user insert
@@ -99,7 +196,38 @@ func (prt *PasswordReset) IsValid() bool {
 	return prt.UsedAt == nil && time.Now().Before(prt.ExpiresAt)
 }
 
-// IsSessionValid checks if session is not expired
+// IsValid checks if session is not expired, rotated or revoked
 func (s *Session) IsValid() bool {
-	return time.Now().Before(s.ExpiresAt)
-}
\ No newline at end of file
+	return s.RotatedAt == nil && s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
+
+// ScopeList returns the scopes an OAuth2 client session is limited to
+func (s *Session) ScopeList() []string {
+	return strings.Fields(s.Scopes)
+}
+
+// IsEmailVerified checks if the user confirmed their current email address
+func (u *User) IsEmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// HasTOTP checks if the user completed TOTP enrollment
+func (u *User) HasTOTP() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// PermissionList returns the permissions granted by the user's role plus any
+// extra ones
+func (u *User) PermissionList() []string {
+	return rbac.Permissions(u.Role, rbac.ParsePermissions(u.Permissions))
+}
+
+// IsValid checks if the action token is unused and not expired
+func (t *ActionToken) IsValid() bool {
+	return t.UsedAt == nil && time.Now().Before(t.ExpiresAt)
+}
+
+// IsLocked checks if the throttle key is currently locked out
+func (t *LoginThrottle) IsLocked() bool {
+	return t.LockedUntil != nil && time.Now().Before(*t.LockedUntil)
+}
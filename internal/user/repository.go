@@ -2,23 +2,32 @@ package user
 
 import (
 	"errors"
-	"rideaware/pkg/database"
+	"time"
+
 	"gorm.io/gorm"
 )
 
-type Repository struct{}
+type Repository struct {
+	db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{db: db}
+}
 
-func NewRepository() *Repository {
-	return &Repository{}
+// WithTx returns a repository that runs its queries in tx, see
+// database.UnitOfWork.
+func (r *Repository) WithTx(tx *gorm.DB) *Repository {
+	return &Repository{db: tx}
 }
 
 func (r *Repository) CreateUser(user *User) error {
-	return database.DB.Create(user).Error
+	return r.db.Create(user).Error
 }
 
 func (r *Repository) GetUserByUsername(username string) (*User, error) {
 	var user User
-	if err := database.DB.Where("username = ?", username).First(&user).Error; err != nil {
+	if err := r.db.Where("username = ?", username).First(&user).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, errors.New("user not found")
 		}
@@ -29,7 +38,7 @@ func (r *Repository) GetUserByUsername(username string) (*User, error) {
 
 func (r *Repository) GetUserByEmail(email string) (*User, error) {
 	var user User
-	if err := database.DB.Where("email = ?", email).First(&user).Error; err != nil {
+	if err := r.db.Where("email = ?", email).First(&user).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, errors.New("user not found")
 		}
@@ -40,7 +49,7 @@ func (r *Repository) GetUserByEmail(email string) (*User, error) {
 
 func (r *Repository) GetUserByID(id uint) (*User, error) {
 	var user User
-	if err := database.DB.Preload("Profile").Where("id = ?", id).First(&user).Error; err != nil {
+	if err := r.db.Preload("Profile").Where("id = ?", id).First(&user).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, errors.New("user not found")
 		}
@@ -50,13 +59,339 @@ func (r *Repository) GetUserByID(id uint) (*User, error) {
 }
 
 func (r *Repository) UpdateUser(user *User) error {
-	return database.DB.Save(user).Error
+	return r.db.Save(user).Error
+}
+
+// UpdateUserRole sets the role and extra permissions of a user.
+func (r *Repository) UpdateUserRole(id uint, role, permissions string) error {
+	result := r.db.Model(&User{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{"role": role, "permissions": permissions})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("user not found")
+	}
+	return nil
+}
+
+// UpdatePasswordHash replaces the password hash unless the password was
+// changed since oldHash was read.
+func (r *Repository) UpdatePasswordHash(id uint, oldHash, newHash string) error {
+	result := r.db.Model(&User{}).
+		Where("id = ? AND password = ?", id, oldHash).
+		Update("password", newHash)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("password was changed concurrently")
+	}
+	return nil
+}
+
+// CancelDeletion reactivates an account that is still waiting to be purged.
+func (r *Repository) CancelDeletion(id uint) error {
+	result := r.db.Model(&User{}).
+		Where("id = ? AND deletion_scheduled_for > ?", id, time.Now()).
+		Updates(map[string]interface{}{"deletion_scheduled_for": nil, "is_active": true})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("account is not scheduled for deletion")
+	}
+	return nil
+}
+
+func (r *Repository) CreatePasswordReset(reset *PasswordReset) error {
+	return r.db.Create(reset).Error
+}
+
+func (r *Repository) GetPasswordReset(token string) (*PasswordReset, error) {
+	var reset PasswordReset
+	if err := r.db.Where("token = ?", token).First(&reset).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("reset token not found")
+		}
+		return nil, err
+	}
+	return &reset, nil
+}
+
+// UsePasswordReset marks an unused reset token as used.
+func (r *Repository) UsePasswordReset(id uint) error {
+	result := r.db.Model(&PasswordReset{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("reset token has already been used")
+	}
+	return nil
 }
 
 func (r *Repository) UserExists(username, email string) (bool, error) {
 	var count int64
-	err := database.DB.Model(&User{}).
+	err := r.db.Model(&User{}).
 		Where("username = ? OR email = ?", username, email).
 		Count(&count).Error
 	return count > 0, err
-}
\ No newline at end of file
+}
+func (r *Repository) CreateSession(session *Session) error {
+	return r.db.Create(session).Error
+}
+
+func (r *Repository) GetSessionByToken(token string) (*Session, error) {
+	var session Session
+	if err := r.db.Where("token = ?", token).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("session not found")
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+// RotateSession marks the session as rotated and stores its successor in one
+// transaction. It fails if the session was rotated or revoked concurrently.
+func (r *Repository) RotateSession(current, next *Session) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Session{}).
+			Where("id = ? AND rotated_at IS NULL AND revoked_at IS NULL", current.ID).
+			Update("rotated_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRefreshTokenReused
+		}
+		return tx.Create(next).Error
+	})
+}
+
+func (r *Repository) RevokeSessionFamily(familyID string) error {
+	return r.db.Model(&Session{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+func (r *Repository) RevokeUserSessionFamily(userID uint, familyID string) error {
+	result := r.db.Model(&Session{}).
+		Where("user_id = ? AND family_id = ? AND revoked_at IS NULL", userID, familyID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("session not found")
+	}
+	return nil
+}
+
+func (r *Repository) GetActiveSessions(userID uint) ([]Session, error) {
+	var sessions []Session
+	if err := r.db.
+		Where("user_id = ? AND client_id = '' AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("created_at DESC").
+		Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (r *Repository) RevokeUserSessions(userID uint) error {
+	return r.db.Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeOtherUserSessions signs the user out everywhere except the session
+// family keepFamilyID.
+func (r *Repository) RevokeOtherUserSessions(userID uint, keepFamilyID string) error {
+	return r.db.Model(&Session{}).
+		Where("user_id = ? AND family_id <> ? AND revoked_at IS NULL", userID, keepFamilyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeUserAccessTokens revokes all of the user's personal access tokens.
+// The table is named directly because the apitoken package imports this one.
+func (r *Repository) RevokeUserAccessTokens(userID uint) error {
+	return r.db.Table("personal_access_tokens").
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// SessionFamilyActive reports whether the user's family still has a live
+// refresh token.
+func (r *Repository) SessionFamilyActive(userID uint, familyID string) (bool, error) {
+	var count int64
+	err := r.db.Model(&Session{}).
+		Where("user_id = ? AND family_id = ? AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > ?",
+			userID, familyID, time.Now()).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (r *Repository) CreateActionToken(token *ActionToken) error {
+	return r.db.Create(token).Error
+}
+
+// ConsumeActionToken marks a valid token for purpose as used and returns it.
+// Each token can be consumed once even under concurrent requests.
+func (r *Repository) ConsumeActionToken(token, purpose string) (*ActionToken, error) {
+	result := r.db.Model(&ActionToken{}).
+		Where("token = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", token, purpose, time.Now()).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errors.New("invalid or expired token")
+	}
+
+	var actionToken ActionToken
+	if err := r.db.Where("token = ?", token).First(&actionToken).Error; err != nil {
+		return nil, err
+	}
+	return &actionToken, nil
+}
+
+// GetRecentActionTokens returns the tokens issued for purpose since the
+// given time, newest first.
+func (r *Repository) GetRecentActionTokens(userID uint, purpose string, since time.Time) ([]ActionToken, error) {
+	var tokens []ActionToken
+	if err := r.db.
+		Where("user_id = ? AND purpose = ? AND created_at > ?", userID, purpose, since).
+		Order("created_at DESC").
+		Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (r *Repository) GetLoginThrottle(key string) (*LoginThrottle, error) {
+	var throttle LoginThrottle
+	if err := r.db.Where("key = ?", key).First(&throttle).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &throttle, nil
+}
+
+// RecordLoginFailure atomically increments the failure count for key. Counts
+// older than window start again from one.
+func (r *Repository) RecordLoginFailure(key string, window time.Duration) (*LoginThrottle, error) {
+	now := time.Now()
+	var throttle LoginThrottle
+	err := r.db.Raw(`
+		INSERT INTO login_throttles (key, failures, last_failure_at, updated_at)
+		VALUES (?, 1, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_throttles.last_failure_at < ? THEN 1 ELSE login_throttles.failures + 1 END,
+			last_failure_at = EXCLUDED.last_failure_at,
+			updated_at = EXCLUDED.updated_at
+		RETURNING *`,
+		key, now, now, now.Add(-window),
+	).Scan(&throttle).Error
+	if err != nil {
+		return nil, err
+	}
+	return &throttle, nil
+}
+
+func (r *Repository) LockLoginThrottle(key string, until time.Time) error {
+	return r.db.Model(&LoginThrottle{}).
+		Where("key = ?", key).
+		Update("locked_until", until).Error
+}
+
+func (r *Repository) DeleteLoginThrottle(key string) error {
+	return r.db.Where("key = ?", key).Delete(&LoginThrottle{}).Error
+}
+
+// AdvanceTOTPStep records step as the last accepted TOTP step. It fails if
+// that step or a later one was already used.
+func (r *Repository) AdvanceTOTPStep(userID uint, step int64) error {
+	result := r.db.Model(&User{}).
+		Where("id = ? AND totp_last_step < ?", userID, step).
+		Update("totp_last_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("code has already been used")
+	}
+	return nil
+}
+
+// ReplaceRecoveryCodes discards the user's recovery codes and stores hashes.
+func (r *Repository) ReplaceRecoveryCodes(userID uint, hashes []string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		codes := make([]RecoveryCode, 0, len(hashes))
+		for _, hash := range hashes {
+			codes = append(codes, RecoveryCode{UserID: userID, CodeHash: hash})
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+func (r *Repository) DeleteRecoveryCodes(userID uint) error {
+	return r.db.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+}
+
+// UseRecoveryCode marks an unused recovery code as used.
+func (r *Repository) UseRecoveryCode(userID uint, hash string) error {
+	result := r.db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hash).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("invalid recovery code")
+	}
+	return nil
+}
+
+func (r *Repository) GetIdentity(provider, subject string) (*Identity, error) {
+	var identity Identity
+	if err := r.db.Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("identity not found")
+		}
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (r *Repository) CreateIdentity(identity *Identity) error {
+	return r.db.Create(identity).Error
+}
+
+// CreateUserWithIdentity inserts a new user and its first identity together.
+func (r *Repository) CreateUserWithIdentity(user *User, identity *Identity) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		identity.UserID = user.ID
+		return tx.Create(identity).Error
+	})
+}
+
+func (r *Repository) UsernameExists(username string) (bool, error) {
+	var count int64
+	err := r.db.Model(&User{}).
+		Where("username = ?", username).
+		Count(&count).Error
+	return count > 0, err
+}
@@ -1,30 +1,117 @@
 package user
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"log"
 	"regexp"
+	"strings"
 	"time"
 
+	"rideaware/internal/audit"
 	"rideaware/internal/config"
 	"rideaware/internal/email"
+	"rideaware/internal/rbac"
 	"rideaware/pkg/database"
+	"rideaware/pkg/totp"
+
+	"gorm.io/gorm"
+)
+
+// Login throttling settings.
+const (
+	loginFailureWindow      = 15 * time.Minute
+	backoffAfterFailures    = 3
+	maxLoginBackoff         = time.Minute
+	accountLockoutThreshold = 10
+	ipLockoutThreshold      = 50
+	lockoutDuration         = 15 * time.Minute
+)
+
+const recoveryCodeCount = 10
+
+// Magic link settings.
+const (
+	magicLinkResendInterval = time.Minute
+	maxMagicLinksPerHour    = 5
+)
+
+var usernameCleaner = regexp.MustCompile(`[^a-z0-9._-]`)
+
+// Email verification settings.
+const (
+	verificationTokenDuration   = 24 * time.Hour
+	emailRevertTokenDuration    = 7 * 24 * time.Hour
+	verificationResendInterval  = time.Minute
+	maxVerificationEmailsPerDay = 5
 )
 
+// ErrVerificationThrottled is returned when verification emails are
+// requested too often.
+var ErrVerificationThrottled = errors.New("verification email was sent recently, try again later")
+
+// LoginBlockedError is returned by VerifyUser while further attempts are
+// refused. Code is "account_locked", "ip_locked" or "too_many_attempts".
+type LoginBlockedError struct {
+	Code       string
+	RetryAfter time.Duration
+}
+
+func (e *LoginBlockedError) Error() string {
+	switch e.Code {
+	case "account_locked":
+		return "account is temporarily locked due to too many failed login attempts"
+	case "ip_locked":
+		return "too many failed login attempts from this address"
+	default:
+		return "too many failed login attempts, try again later"
+	}
+}
+
+// ErrPendingDeletion is returned on login to an account scheduled for
+// deletion.
+var ErrPendingDeletion = errors.New("account is scheduled for deletion, use the link we emailed you to restore it")
+
+// ErrRefreshTokenReused is returned when a refresh token that was already
+// rotated is presented again. Its whole token family is revoked when it happens.
+var ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+
 type Service struct {
 	repo  *Repository
 	email *email.Service
+	audit *audit.Service
+	uow   *database.UnitOfWork
+
+	// deletionGracePeriod is how long a deleted account can be restored
+	// before it is purged.
+	deletionGracePeriod time.Duration
 }
 
-func NewService() *Service {
+func NewService(db *gorm.DB, cfg config.AccountsConfig, mailer *email.Service, auditor *audit.Service) *Service {
 	return &Service{
-		repo:  NewRepository(),
-		email: email.NewService(),
+		repo:                NewRepository(db),
+		email:               mailer,
+		audit:               auditor,
+		uow:                 database.NewUnitOfWork(db),
+		deletionGracePeriod: cfg.DeletionGracePeriod,
 	}
 }
 
-func (s *Service) CreateUser(username, password, email, firstName, lastName string) (*User, error) {
+// WithTx returns a copy of the service whose queries run in tx, so its writes
+// can join a unit of work started by another service.
+func (s *Service) WithTx(tx *gorm.DB) *Service {
+	txService := *s
+	txService.repo = s.repo.WithTx(tx)
+	txService.uow = database.NewUnitOfWork(tx)
+	return &txService
+}
+
+func (s *Service) CreateUser(ctx context.Context, username, password, email, firstName, lastName string) (*User, error) {
 	if username == "" || password == "" {
 		return nil, errors.New("username and password are required")
 	}
@@ -56,104 +143,1253 @@ func (s *Service) CreateUser(username, password, email, firstName, lastName stri
 		return nil, err
 	}
 
-	_ = s.email.SendWelcomeEmail(email, username)
+	s.audit.Record(ctx, selfEvent(user.ID, audit.ActionSignup))
+
+	if email != "" {
+		if err := s.sendVerificationEmail(user); err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		}
+	}
 
 	return user, nil
 }
 
-func (s *Service) VerifyUser(username, password string) (*User, error) {
-	user, err := s.repo.GetUserByUsername(username)
+// ProfileUpdate holds the editable profile fields.
+type ProfileUpdate struct {
+	FirstName string
+	LastName  string
+	Bio       string
+	FTP       int
+	MaxHR     int
+	Weight    float64
+}
+
+// UpdateProfile saves the editable profile fields of a user.
+func (s *Service) UpdateProfile(ctx context.Context, userID uint, update ProfileUpdate) (*User, error) {
+	user, err := s.repo.GetUserByID(userID)
 	if err != nil {
-		return nil, errors.New("invalid username or password")
+		return nil, err
+	}
+	if user.Profile == nil {
+		return user, nil
 	}
 
-	if !user.CheckPassword(password) {
-		return nil, errors.New("invalid username or password")
+	before := *user.Profile
+	user.Profile.FirstName = update.FirstName
+	user.Profile.LastName = update.LastName
+	user.Profile.Bio = update.Bio
+	user.Profile.FTP = update.FTP
+	user.Profile.MaxHR = update.MaxHR
+	user.Profile.Weight = update.Weight
+
+	if err := s.repo.UpdateUser(user); err != nil {
+		return nil, err
+	}
+
+	if changes := audit.Diff(before, user.Profile); changes != nil {
+		event := audit.UserEvent(user.ID, audit.ActionProfileUpdated)
+		event.Changes = changes
+		s.audit.Record(ctx, event)
 	}
 
 	return user, nil
 }
 
-func (s *Service) RequestPasswordReset(email string) error {
-	user, err := s.repo.GetUserByEmail(email)
+// VerifyEmail confirms the address a verification token was sent to.
+func (s *Service) VerifyEmail(ctx context.Context, token string) (*User, error) {
+	actionToken, err := s.repo.ConsumeActionToken(token, ActionVerifyEmail)
 	if err != nil {
-		// Don't leak if email exists
-		return nil
+		return nil, err
 	}
 
-	token, err := generateSecureToken(32)
+	user, err := s.repo.GetUserByID(actionToken.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.EqualFold(user.Email, actionToken.Data) {
+		return nil, errors.New("verification token does not match the current email address")
+	}
+
+	if user.IsEmailVerified() {
+		return user, nil
+	}
+
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+	if err := s.repo.UpdateUser(user); err != nil {
+		return nil, err
+	}
+
+	s.audit.Record(ctx, selfEvent(user.ID, audit.ActionEmailVerified))
+
+	_ = s.email.SendWelcomeEmail(user.Email, user.Username)
+
+	return user, nil
+}
+
+// ResendVerificationEmail sends a fresh verification link, at most once a
+// minute and a few times a day.
+func (s *Service) ResendVerificationEmail(userID uint) error {
+	user, err := s.repo.GetUserByID(userID)
 	if err != nil {
 		return err
 	}
 
-	resetToken := &PasswordReset{
-		UserID:    user.ID,
-		Token:     token,
-		ExpiresAt: time.Now().Add(config.JWT.ResetTokenDuration),
+	if user.Email == "" {
+		return errors.New("no email address on file")
+	}
+	if user.IsEmailVerified() {
+		return errors.New("email address is already verified")
+	}
+
+	recent, err := s.repo.GetRecentActionTokens(userID, ActionVerifyEmail, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		return err
 	}
+	if len(recent) >= maxVerificationEmailsPerDay ||
+		(len(recent) > 0 && time.Since(recent[0].CreatedAt) < verificationResendInterval) {
+		return ErrVerificationThrottled
+	}
+
+	return s.sendVerificationEmail(user)
+}
 
-	if err := database.DB.Create(resetToken).Error; err != nil {
+func (s *Service) sendVerificationEmail(user *User) error {
+	token, err := s.issueActionToken(user.ID, ActionVerifyEmail, user.Email, verificationTokenDuration)
+	if err != nil {
 		return err
 	}
 
-	resetLink := "https://rideaware.app/reset-password?token=" + token
-	return s.email.SendPasswordResetEmail(user.Email, user.Username, resetLink)
+	verifyLink := "https://rideaware.app/verify-email?token=" + token
+	return s.email.SendVerificationEmail(user.Email, user.Username, verifyLink)
 }
 
-func (s *Service) ResetPassword(token, newPassword string) error {
-	if len(newPassword) < 8 {
-		return errors.New("password must be at least 8 characters long")
+// VerifyUser checks the credentials of a login attempt made from ipAddress.
+// Failed attempts are counted per username and per address: after a few
+// failures each further attempt has to wait progressively longer, and once a
+// threshold is reached the key is locked out for a while. Locking an account
+// emails its owner an unlock link.
+func (s *Service) VerifyUser(ctx context.Context, username, password, ipAddress string) (*User, error) {
+	userKey := "user:" + strings.ToLower(username)
+	ipKey := "ip:" + ipAddress
+
+	if err := s.checkLoginThrottle(userKey, "account_locked"); err != nil {
+		return nil, err
+	}
+	if err := s.checkLoginThrottle(ipKey, "ip_locked"); err != nil {
+		return nil, err
 	}
 
-	var resetToken PasswordReset
-	if err := database.DB.Where("token = ?", token).First(&resetToken).Error; err != nil {
-		return errors.New("invalid or expired reset token")
+	user, err := s.repo.GetUserByUsername(username)
+	if err != nil || !s.checkPassword(user, password) {
+		event := audit.Event{Action: audit.ActionLoginFailed}
+		if user != nil {
+			event.UserID = &user.ID
+		}
+		s.audit.Record(ctx, event)
+		s.recordLoginFailure(ctx, ipKey, ipLockoutThreshold, nil)
+		s.recordLoginFailure(ctx, userKey, accountLockoutThreshold, user)
+		return nil, errors.New("invalid username or password")
 	}
 
-	if !resetToken.IsValid() {
-		return errors.New("reset token has expired")
+	if user.DeletionScheduledFor != nil {
+		return nil, ErrPendingDeletion
+	}
+	if !user.IsActive {
+		return nil, errors.New("account is disabled")
 	}
 
-	user, err := s.repo.GetUserByID(resetToken.UserID)
+	// With two-factor enabled the password alone doesn't end the attempt, so
+	// failures are only cleared once the second factor succeeds.
+	if !user.HasTOTP() {
+		if err := s.repo.DeleteLoginThrottle(userKey); err != nil {
+			return nil, err
+		}
+	}
+
+	s.recordLogin(ctx, user)
+	return user, nil
+}
+
+// VerifyLoginMFA checks the second factor of a login challenge. Wrong codes
+// count against the same throttles as wrong passwords.
+func (s *Service) VerifyLoginMFA(ctx context.Context, userID uint, code, ipAddress string) (*User, error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.HasTOTP() {
+		return nil, errors.New("two-factor authentication is not enabled")
+	}
+
+	userKey := "user:" + strings.ToLower(user.Username)
+	ipKey := "ip:" + ipAddress
+
+	if err := s.checkLoginThrottle(userKey, "account_locked"); err != nil {
+		return nil, err
+	}
+	if err := s.checkLoginThrottle(ipKey, "ip_locked"); err != nil {
+		return nil, err
+	}
+
+	if err := s.verifySecondFactor(user, code); err != nil {
+		s.audit.Record(ctx, audit.Event{UserID: &user.ID, Action: audit.ActionLoginFailed})
+		s.recordLoginFailure(ctx, ipKey, ipLockoutThreshold, nil)
+		s.recordLoginFailure(ctx, userKey, accountLockoutThreshold, user)
+		return nil, errors.New("invalid authentication code")
+	}
+
+	if err := s.repo.DeleteLoginThrottle(userKey); err != nil {
+		return nil, err
+	}
+
+	s.audit.Record(ctx, selfEvent(user.ID, audit.ActionLogin))
+	return user, nil
+}
+
+// EnrollTOTP generates a pending TOTP secret and the otpauth:// URI to load
+// into an authenticator app. It becomes active once confirmed with a code.
+func (s *Service) EnrollTOTP(userID uint) (string, string, error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return "", "", err
+	}
+	if user.HasTOTP() {
+		return "", "", errors.New("two-factor authentication is already enabled")
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+
+	user.TOTPSecret = secret
+	if err := s.repo.UpdateUser(user); err != nil {
+		return "", "", err
+	}
+
+	account := user.Email
+	if account == "" {
+		account = user.Username
+	}
+
+	return secret, totp.URI("RideAware", account, secret), nil
+}
+
+// ConfirmTOTP enables two-factor authentication with the first code from the
+// authenticator and returns a fresh set of recovery codes.
+func (s *Service) ConfirmTOTP(ctx context.Context, userID uint, code string) ([]string, error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.HasTOTP() {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+	if user.TOTPSecret == "" {
+		return nil, errors.New("two-factor enrollment has not been started")
+	}
+
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now(), 1)
+	if !ok {
+		return nil, errors.New("invalid authentication code")
+	}
+
+	now := time.Now()
+	user.TOTPEnabledAt = &now
+	user.TOTPLastStep = step
+	if err := s.repo.UpdateUser(user); err != nil {
+		return nil, err
+	}
+
+	s.audit.Record(ctx, audit.UserEvent(user.ID, audit.ActionMFAEnabled))
+	return s.generateRecoveryCodes(user.ID)
+}
+
+// ChangePassword sets a new password after re-checking the current one. Every
+// session except keepSessionID, the one making the change, is signed out, and
+// personal access tokens are revoked.
+func (s *Service) ChangePassword(ctx context.Context, userID uint, keepSessionID, currentPassword, newPassword string) error {
+	user, err := s.repo.GetUserByID(userID)
 	if err != nil {
 		return err
 	}
+	if !s.checkPassword(user, currentPassword) {
+		return errors.New("current password is incorrect")
+	}
 
+	oldHash := user.Password
 	if err := user.SetPassword(newPassword); err != nil {
 		return err
 	}
+	if err := s.uow.Do(ctx, func(tx *gorm.DB) error {
+		users := s.repo.WithTx(tx)
+		if err := users.UpdatePasswordHash(user.ID, oldHash, user.Password); err != nil {
+			return err
+		}
+		if err := users.RevokeOtherUserSessions(user.ID, keepSessionID); err != nil {
+			return err
+		}
+		return users.RevokeUserAccessTokens(user.ID)
+	}); err != nil {
+		return err
+	}
+
+	s.audit.Record(ctx, audit.UserEvent(user.ID, audit.ActionPasswordChanged))
+
+	if user.Email != "" {
+		if err := s.email.SendPasswordChangedEmail(user.Email, user.Username); err != nil {
+			log.Printf("Failed to send password change notice to user %d: %v", user.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// RequestEmailChange emails a confirmation link to newEmail. The address is
+// only changed once the link is followed.
+func (s *Service) RequestEmailChange(ctx context.Context, userID uint, password, newEmail string) error {
+	newEmail = strings.TrimSpace(newEmail)
+	if !isValidEmail(newEmail) {
+		return errors.New("invalid email format")
+	}
+
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if !s.checkPassword(user, password) {
+		return errors.New("invalid password")
+	}
+	if strings.EqualFold(user.Email, newEmail) {
+		return errors.New("this is already your email address")
+	}
+	if _, err := s.repo.GetUserByEmail(newEmail); err == nil {
+		return errors.New("email address is already in use")
+	}
+
+	recent, err := s.repo.GetRecentActionTokens(userID, ActionChangeEmail, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		return err
+	}
+	if len(recent) >= maxVerificationEmailsPerDay ||
+		(len(recent) > 0 && time.Since(recent[0].CreatedAt) < verificationResendInterval) {
+		return ErrVerificationThrottled
+	}
+
+	token, err := s.issueActionToken(user.ID, ActionChangeEmail, newEmail, verificationTokenDuration)
+	if err != nil {
+		return err
+	}
+
+	event := audit.UserEvent(user.ID, audit.ActionEmailChangeRequested)
+	event.Changes = audit.Changes{"email": {From: user.Email, To: newEmail}}
+	s.audit.Record(ctx, event)
+
+	confirmLink := "https://rideaware.app/confirm-email-change?token=" + token
+	return s.email.SendEmailChangeConfirmationEmail(newEmail, user.Username, confirmLink)
+}
+
+// ConfirmEmailChange switches the account to the address the token was sent
+// to. The previous address is told about the change and gets a link to
+// revert it.
+func (s *Service) ConfirmEmailChange(ctx context.Context, token string) (*User, error) {
+	actionToken, err := s.repo.ConsumeActionToken(token, ActionChangeEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.repo.GetUserByID(actionToken.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if existing, err := s.repo.GetUserByEmail(actionToken.Data); err == nil && existing.ID != user.ID {
+		return nil, errors.New("email address is already in use")
+	}
+
+	oldEmail := user.Email
+	now := time.Now()
+	user.Email = actionToken.Data
+	user.EmailVerifiedAt = &now
+	if err := s.repo.UpdateUser(user); err != nil {
+		return nil, err
+	}
+
+	event := selfEvent(user.ID, audit.ActionEmailChanged)
+	event.Changes = audit.Changes{"email": {From: oldEmail, To: user.Email}}
+	s.audit.Record(ctx, event)
+
+	if oldEmail != "" {
+		revertToken, err := s.issueActionToken(user.ID, ActionRevertEmail, oldEmail, emailRevertTokenDuration)
+		if err != nil {
+			return nil, err
+		}
+		revertLink := "https://rideaware.app/revert-email-change?token=" + revertToken
+		if err := s.email.SendEmailChangedEmail(oldEmail, user.Username, user.Email, revertLink); err != nil {
+			log.Printf("Failed to send email change notice to user %d: %v", user.ID, err)
+		}
+	}
+
+	return user, nil
+}
+
+// RevertEmailChange restores the address a change notice was sent to. As the
+// change may not have been made by the owner, every session is signed out.
+func (s *Service) RevertEmailChange(ctx context.Context, token string) error {
+	actionToken, err := s.repo.ConsumeActionToken(token, ActionRevertEmail)
+	if err != nil {
+		return err
+	}
+
+	user, err := s.repo.GetUserByID(actionToken.UserID)
+	if err != nil {
+		return err
+	}
+	if existing, err := s.repo.GetUserByEmail(actionToken.Data); err == nil && existing.ID != user.ID {
+		return errors.New("email address is already in use")
+	}
 
+	oldEmail := user.Email
 	now := time.Now()
-	tx := database.DB.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
+	user.Email = actionToken.Data
+	user.EmailVerifiedAt = &now
+	if err := s.repo.UpdateUser(user); err != nil {
+		return err
+	}
+
+	event := selfEvent(user.ID, audit.ActionEmailChangeReverted)
+	event.Changes = audit.Changes{"email": {From: oldEmail, To: user.Email}}
+	s.audit.Record(ctx, event)
+
+	return s.repo.RevokeUserSessions(user.ID)
+}
+
+// checkPassword verifies the user's password, storing the upgraded hash when
+// the old one used bcrypt or outdated parameters.
+func (s *Service) checkPassword(user *User, password string) bool {
+	oldHash := user.Password
+	ok, upgraded := user.CheckPassword(password)
+	if upgraded {
+		if err := s.repo.UpdatePasswordHash(user.ID, oldHash, user.Password); err != nil {
+			log.Printf("Failed to upgrade password hash for user %d: %v", user.ID, err)
 		}
-	}()
+	}
+	return ok
+}
 
-	if err := tx.Model(user).Update("password", user.Password).Error; err != nil {
-		tx.Rollback()
+// DisableTOTP turns two-factor authentication off after re-checking the
+// password and discards the recovery codes.
+func (s *Service) DisableTOTP(ctx context.Context, userID uint, password string) error {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
 		return err
 	}
+	if !s.checkPassword(user, password) {
+		return errors.New("invalid password")
+	}
 
-	if err := tx.Model(&resetToken).Update("used_at", now).Error; err != nil {
-		tx.Rollback()
+	user.TOTPSecret = ""
+	user.TOTPEnabledAt = nil
+	user.TOTPLastStep = 0
+	if err := s.repo.UpdateUser(user); err != nil {
 		return err
 	}
 
-	return tx.Commit().Error
+	s.audit.Record(ctx, audit.UserEvent(user.ID, audit.ActionMFADisabled))
+	return s.repo.DeleteRecoveryCodes(user.ID)
 }
 
-// Helper functions
-func isValidEmail(email string) bool {
-	regex := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
-	return regex.MatchString(email)
+// RegenerateRecoveryCodes replaces all recovery codes, authorised by a
+// current second factor.
+func (s *Service) RegenerateRecoveryCodes(ctx context.Context, userID uint, code string) ([]string, error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.HasTOTP() {
+		return nil, errors.New("two-factor authentication is not enabled")
+	}
+	if err := s.verifySecondFactor(user, code); err != nil {
+		return nil, errors.New("invalid authentication code")
+	}
+
+	s.audit.Record(ctx, audit.UserEvent(user.ID, audit.ActionRecoveryCodesRegenerated))
+	return s.generateRecoveryCodes(user.ID)
 }
 
-func generateSecureToken(length int) (string, error) {
-	b := make([]byte, length)
-	if _, err := rand.Read(b); err != nil {
-		return "", err
+// verifySecondFactor accepts either a current TOTP code or an unused
+// recovery code.
+func (s *Service) verifySecondFactor(user *User, code string) error {
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now(), 1); ok {
+		return s.repo.AdvanceTOTPStep(user.ID, step)
 	}
-	return base64.URLEncoding.EncodeToString(b), nil
-}
\ No newline at end of file
+	return s.repo.UseRecoveryCode(user.ID, hashRecoveryCode(code))
+}
+
+func (s *Service) generateRecoveryCodes(userID uint) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := base32.StdEncoding.EncodeToString(b)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	if err := s.repo.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// UnlockAccount clears the lockout of the account an unlock token was
+// emailed for.
+func (s *Service) UnlockAccount(ctx context.Context, token string) error {
+	actionToken, err := s.repo.ConsumeActionToken(token, ActionUnlockAccount)
+	if err != nil {
+		return err
+	}
+
+	user, err := s.repo.GetUserByID(actionToken.UserID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.repo.DeleteLoginThrottle("user:" + strings.ToLower(user.Username)); err != nil {
+		return err
+	}
+
+	s.audit.Record(ctx, selfEvent(user.ID, audit.ActionAccountUnlocked))
+	return nil
+}
+
+// checkLoginThrottle refuses the attempt while key is locked out or still
+// inside the back-off delay of its last failure.
+func (s *Service) checkLoginThrottle(key, lockedCode string) error {
+	throttle, err := s.repo.GetLoginThrottle(key)
+	if err != nil {
+		return err
+	}
+	if throttle == nil {
+		return nil
+	}
+
+	if throttle.IsLocked() {
+		return &LoginBlockedError{
+			Code:       lockedCode,
+			RetryAfter: time.Until(*throttle.LockedUntil),
+		}
+	}
+
+	if time.Since(throttle.LastFailureAt) > loginFailureWindow {
+		return nil
+	}
+
+	if wait := time.Until(throttle.LastFailureAt.Add(loginBackoff(throttle.Failures))); wait > 0 {
+		return &LoginBlockedError{
+			Code:       "too_many_attempts",
+			RetryAfter: wait,
+		}
+	}
+
+	return nil
+}
+
+// recordLoginFailure counts a failure against key and locks it once threshold
+// is reached. When user is set its owner is emailed an unlock link.
+func (s *Service) recordLoginFailure(ctx context.Context, key string, threshold int, user *User) {
+	throttle, err := s.repo.RecordLoginFailure(key, loginFailureWindow)
+	if err != nil {
+		log.Printf("Failed to record login failure for %s: %v", key, err)
+		return
+	}
+	if throttle.Failures < threshold {
+		return
+	}
+
+	until := time.Now().Add(lockoutDuration)
+	if err := s.repo.LockLoginThrottle(key, until); err != nil {
+		log.Printf("Failed to lock %s: %v", key, err)
+		return
+	}
+
+	if user == nil {
+		return
+	}
+
+	s.audit.Record(ctx, audit.Event{UserID: &user.ID, Action: audit.ActionAccountLocked})
+
+	if user.Email == "" {
+		return
+	}
+
+	token, err := s.issueActionToken(user.ID, ActionUnlockAccount, "", lockoutDuration)
+	if err != nil {
+		log.Printf("Failed to issue unlock token for user %d: %v", user.ID, err)
+		return
+	}
+
+	unlockLink := "https://rideaware.app/unlock-account?token=" + token
+	_ = s.email.SendAccountLockedEmail(user.Email, user.Username, unlockLink, until)
+}
+
+// RequestMagicLink emails a single-use sign-in link to a verified address.
+// Like password resets it reports nothing about whether the address is
+// known, so requests for unknown, unverified or throttled addresses are
+// dropped silently.
+func (s *Service) RequestMagicLink(email string) error {
+	user, err := s.repo.GetUserByEmail(email)
+	if err != nil {
+		return nil
+	}
+
+	if !user.IsEmailVerified() || !user.IsActive || user.DeletionScheduledFor != nil {
+		return nil
+	}
+
+	recent, err := s.repo.GetRecentActionTokens(user.ID, ActionMagicLink, time.Now().Add(-time.Hour))
+	if err != nil {
+		return err
+	}
+	if len(recent) >= maxMagicLinksPerHour ||
+		(len(recent) > 0 && time.Since(recent[0].CreatedAt) < magicLinkResendInterval) {
+		return nil
+	}
+
+	token, err := s.issueActionToken(user.ID, ActionMagicLink, user.Email, config.JWT.MagicLinkDuration)
+	if err != nil {
+		return err
+	}
+
+	loginLink := "https://rideaware.app/magic-login?token=" + token
+	return s.email.SendMagicLinkEmail(user.Email, user.Username, loginLink, config.JWT.MagicLinkDuration)
+}
+
+// LoginWithMagicLink consumes a magic link token and returns its user. The
+// link only counts as a first factor, users with two-factor authentication
+// still have to complete the challenge.
+func (s *Service) LoginWithMagicLink(ctx context.Context, token string) (*User, error) {
+	actionToken, err := s.repo.ConsumeActionToken(token, ActionMagicLink)
+	if err != nil {
+		return nil, errors.New("invalid or expired sign-in link")
+	}
+
+	user, err := s.repo.GetUserByID(actionToken.UserID)
+	if err != nil {
+		return nil, errors.New("invalid or expired sign-in link")
+	}
+
+	// A link sent before an email change must not outlive the address
+	if !strings.EqualFold(user.Email, actionToken.Data) {
+		return nil, errors.New("invalid or expired sign-in link")
+	}
+
+	if user.DeletionScheduledFor != nil {
+		return nil, ErrPendingDeletion
+	}
+	if !user.IsActive {
+		return nil, errors.New("account is disabled")
+	}
+
+	s.recordLogin(ctx, user)
+	return user, nil
+}
+
+func (s *Service) RequestPasswordReset(ctx context.Context, email string) error {
+	user, err := s.repo.GetUserByEmail(email)
+	if err != nil {
+		// Don't leak if email exists
+		return nil
+	}
+
+	// Only send reset links to addresses the user has proven to own
+	if !user.IsEmailVerified() {
+		return nil
+	}
+
+	token, err := generateSecureToken(32)
+	if err != nil {
+		return err
+	}
+
+	resetToken := &PasswordReset{
+		UserID:    user.ID,
+		Token:     token,
+		ExpiresAt: time.Now().Add(config.JWT.ResetTokenDuration),
+	}
+
+	if err := s.repo.CreatePasswordReset(resetToken); err != nil {
+		return err
+	}
+
+	s.audit.Record(ctx, selfEvent(user.ID, audit.ActionPasswordResetRequested))
+
+	resetLink := "https://rideaware.app/reset-password?token=" + token
+	return s.email.SendPasswordResetEmail(user.Email, user.Username, resetLink)
+}
+
+func (s *Service) ResetPassword(ctx context.Context, token, newPassword string) error {
+	resetToken, err := s.repo.GetPasswordReset(token)
+	if err != nil {
+		return errors.New("invalid or expired reset token")
+	}
+
+	if !resetToken.IsValid() {
+		return errors.New("reset token has expired")
+	}
+
+	user, err := s.repo.GetUserByID(resetToken.UserID)
+	if err != nil {
+		return err
+	}
+
+	oldHash := user.Password
+	if err := user.SetPassword(newPassword); err != nil {
+		return err
+	}
+
+	// The token is only spent if the password really changes, and then
+	// every session, app grant and personal access token is revoked, since
+	// a reset usually means the old password can't be trusted
+	if err := s.uow.Do(ctx, func(tx *gorm.DB) error {
+		users := s.repo.WithTx(tx)
+		if err := users.UsePasswordReset(resetToken.ID); err != nil {
+			return err
+		}
+		if err := users.UpdatePasswordHash(user.ID, oldHash, user.Password); err != nil {
+			return err
+		}
+		if err := users.RevokeUserSessions(user.ID); err != nil {
+			return err
+		}
+		return users.RevokeUserAccessTokens(user.ID)
+	}); err != nil {
+		return err
+	}
+
+	s.audit.Record(ctx, selfEvent(user.ID, audit.ActionPasswordReset))
+
+	return s.repo.DeleteLoginThrottle("user:" + strings.ToLower(user.Username))
+}
+
+// SessionInfo describes the device a session was started from.
+type SessionInfo struct {
+	DeviceName string
+	UserAgent  string
+	IPAddress  string
+}
+
+// CreateSession starts a new refresh token family for the user.
+func (s *Service) CreateSession(userID uint, info SessionInfo) (*Session, error) {
+	return s.createSession(userID, "", nil, info)
+}
+
+// CreateClientSession starts a refresh token family for an OAuth2 client the
+// user authorized, limited to scopes.
+func (s *Service) CreateClientSession(userID uint, clientID string, scopes []string, info SessionInfo) (*Session, error) {
+	return s.createSession(userID, clientID, scopes, info)
+}
+
+func (s *Service) createSession(userID uint, clientID string, scopes []string, info SessionInfo) (*Session, error) {
+	token, err := generateSecureToken(32)
+	if err != nil {
+		return nil, err
+	}
+	familyID, err := generateSecureToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		UserID:     userID,
+		Token:      token,
+		FamilyID:   familyID,
+		ExpiresAt:  time.Now().Add(config.JWT.RefreshTokenDuration),
+		DeviceName: info.DeviceName,
+		UserAgent:  info.UserAgent,
+		IPAddress:  info.IPAddress,
+		ClientID:   clientID,
+		Scopes:     strings.Join(scopes, " "),
+	}
+
+	if err := s.repo.CreateSession(session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// RefreshSession rotates the session identified by the refresh token jti and
+// returns its owner together with the successor session. Presenting a token
+// that was already rotated revokes the whole family. The successor keeps the
+// device name but records the user agent and address the refresh came from.
+// clientID must match the OAuth2 client the session belongs to, and be empty
+// for first-party sessions.
+func (s *Service) RefreshSession(token, clientID string, info SessionInfo) (*User, *Session, error) {
+	current, err := s.repo.GetSessionByToken(token)
+	if err != nil || current.ClientID != clientID {
+		return nil, nil, errors.New("invalid refresh token")
+	}
+
+	if current.RotatedAt != nil {
+		if err := s.repo.RevokeSessionFamily(current.FamilyID); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrRefreshTokenReused
+	}
+
+	if !current.IsValid() {
+		return nil, nil, errors.New("session has expired or been revoked")
+	}
+
+	user, err := s.repo.GetUserByID(current.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !user.IsActive {
+		return nil, nil, errors.New("account is disabled")
+	}
+
+	nextToken, err := generateSecureToken(32)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	next := &Session{
+		UserID:     current.UserID,
+		Token:      nextToken,
+		FamilyID:   current.FamilyID,
+		ExpiresAt:  time.Now().Add(config.JWT.RefreshTokenDuration),
+		DeviceName: current.DeviceName,
+		UserAgent:  info.UserAgent,
+		IPAddress:  info.IPAddress,
+		ClientID:   current.ClientID,
+		Scopes:     current.Scopes,
+	}
+
+	if err := s.repo.RotateSession(current, next); err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			if err := s.repo.RevokeSessionFamily(current.FamilyID); err != nil {
+				return nil, nil, err
+			}
+		}
+		return nil, nil, err
+	}
+
+	return user, next, nil
+}
+
+// GetActiveUser returns the user if the account can still sign in.
+func (s *Service) GetActiveUser(userID uint) (*User, error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsActive || user.DeletionScheduledFor != nil {
+		return nil, errors.New("account is disabled")
+	}
+	return user, nil
+}
+
+// GetActiveSessions lists the live session of every signed-in device.
+func (s *Service) GetActiveSessions(userID uint) ([]Session, error) {
+	return s.repo.GetActiveSessions(userID)
+}
+
+// RevokeSession ends a single session family belonging to the user.
+func (s *Service) RevokeSession(ctx context.Context, userID uint, familyID string) error {
+	if err := s.repo.RevokeUserSessionFamily(userID, familyID); err != nil {
+		return err
+	}
+
+	s.audit.Record(ctx, audit.UserEvent(userID, audit.ActionSessionRevoked))
+	return nil
+}
+
+// RevokeAllSessions signs the user out of every device.
+func (s *Service) RevokeAllSessions(ctx context.Context, userID uint) error {
+	if err := s.repo.RevokeUserSessions(userID); err != nil {
+		return err
+	}
+
+	s.audit.Record(ctx, audit.UserEvent(userID, audit.ActionAllSessionsRevoked))
+	return nil
+}
+
+// IsSessionActive implements middleware.SessionValidator.
+func (s *Service) IsSessionActive(userID uint, familyID string) bool {
+	if familyID == "" {
+		return false
+	}
+	active, err := s.repo.SessionFamilyActive(userID, familyID)
+	return err == nil && active
+}
+
+// ScheduleDeletion deactivates the account after re-checking the password and
+// schedules it to be purged once the grace period has passed. The user is
+// signed out everywhere and emailed a link to undo the deletion.
+func (s *Service) ScheduleDeletion(ctx context.Context, userID uint, password string) (*User, error) {
+	user, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !s.checkPassword(user, password) {
+		return nil, errors.New("invalid password")
+	}
+	if user.DeletionScheduledFor != nil {
+		return nil, errors.New("account is already scheduled for deletion")
+	}
+
+	purgeAt := time.Now().Add(s.deletionGracePeriod)
+	user.DeletionScheduledFor = &purgeAt
+	user.IsActive = false
+	if err := s.repo.UpdateUser(user); err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.RevokeUserSessions(user.ID); err != nil {
+		return nil, err
+	}
+
+	s.audit.Record(ctx, audit.UserEvent(user.ID, audit.ActionDeletionScheduled))
+
+	token, err := s.issueActionToken(user.ID, ActionUndoDeletion, "", s.deletionGracePeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	undoLink := "https://rideaware.app/restore-account?token=" + token
+	if err := s.email.SendDeletionScheduledEmail(user.Email, user.Username, undoLink, purgeAt); err != nil {
+		log.Printf("Failed to send deletion email to user %d: %v", user.ID, err)
+	}
+
+	return user, nil
+}
+
+// RestoreAccount undoes a scheduled deletion using the emailed token.
+func (s *Service) RestoreAccount(ctx context.Context, token string) error {
+	actionToken, err := s.repo.ConsumeActionToken(token, ActionUndoDeletion)
+	if err != nil {
+		return err
+	}
+
+	if err := s.repo.CancelDeletion(actionToken.UserID); err != nil {
+		return err
+	}
+
+	s.audit.Record(ctx, selfEvent(actionToken.UserID, audit.ActionAccountRestored))
+	return nil
+}
+
+// SetUserRole changes the role and extra permissions of a user. The user's
+// sessions are revoked in the same transaction so tokens carrying the old
+// permissions stop working.
+// Admins cannot change their own role, so the last admin cannot lock
+// everyone out by accident.
+func (s *Service) SetUserRole(ctx context.Context, adminID, userID uint, role string, permissions []string) (*User, error) {
+	if adminID == userID {
+		return nil, errors.New("you cannot change your own role")
+	}
+	if !rbac.ValidRole(role) {
+		return nil, errors.New("unknown role")
+	}
+	for _, p := range permissions {
+		if !rbac.ValidPermission(p) {
+			return nil, errors.New("unknown permission " + p)
+		}
+	}
+
+	before, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.uow.Do(ctx, func(tx *gorm.DB) error {
+		users := s.repo.WithTx(tx)
+		if err := users.UpdateUserRole(userID, role, strings.Join(permissions, " ")); err != nil {
+			return err
+		}
+		return users.RevokeUserSessions(userID)
+	}); err != nil {
+		return nil, err
+	}
+
+	after, err := s.repo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	event := audit.UserEvent(userID, audit.ActionRoleChanged)
+	event.Changes = audit.Diff(
+		map[string]interface{}{"role": before.Role, "permissions": before.PermissionList()},
+		map[string]interface{}{"role": after.Role, "permissions": after.PermissionList()},
+	)
+	s.audit.Record(ctx, event)
+
+	return after, nil
+}
+
+// Impersonate checks that adminID may act as userID and records that support
+// access began. Accounts that can impersonate others cannot be impersonated
+// themselves.
+func (s *Service) Impersonate(ctx context.Context, adminID, userID uint) (*User, error) {
+	if adminID == userID {
+		return nil, errors.New("you cannot impersonate yourself")
+	}
+
+	user, err := s.GetActiveUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if rbac.Has(user.PermissionList(), rbac.UsersImpersonate) {
+		return nil, errors.New("this user cannot be impersonated")
+	}
+
+	s.audit.Record(ctx, audit.UserEvent(userID, audit.ActionImpersonationStarted))
+	return user, nil
+}
+
+// ExternalIdentity is a user identity asserted by an OAuth2/OIDC provider.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+}
+
+// LoginWithIdentity resolves the user behind an external identity. Known
+// identities sign in their linked user. Otherwise the identity is linked to
+// the account with the same verified email, or a new account is created.
+func (s *Service) LoginWithIdentity(ctx context.Context, ext ExternalIdentity) (*User, error) {
+	if identity, err := s.repo.GetIdentity(ext.Provider, ext.Subject); err == nil {
+		user, err := s.repo.GetUserByID(identity.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if !user.IsActive {
+			return nil, errors.New("account is disabled")
+		}
+		s.recordLogin(ctx, user)
+		return user, nil
+	}
+
+	if ext.Email == "" || !ext.EmailVerified {
+		return nil, errors.New("provider did not return a verified email address, sign in and link the provider instead")
+	}
+
+	identity := &Identity{
+		Provider: ext.Provider,
+		Subject:  ext.Subject,
+		Email:    ext.Email,
+	}
+
+	if user, err := s.repo.GetUserByEmail(ext.Email); err == nil {
+		if !user.IsActive {
+			return nil, errors.New("account is disabled")
+		}
+		if !user.IsEmailVerified() {
+			if err := s.claimUnverifiedAccount(user); err != nil {
+				return nil, err
+			}
+		}
+		identity.UserID = user.ID
+		if err := s.repo.CreateIdentity(identity); err != nil {
+			return nil, err
+		}
+		s.audit.Record(ctx, selfEvent(user.ID, audit.ActionIdentityLinked))
+		s.recordLogin(ctx, user)
+		return user, nil
+	}
+
+	username, err := s.availableUsername(ext.Username, ext.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := generateSecureToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	user := &User{
+		Username:        username,
+		Email:           ext.Email,
+		EmailVerifiedAt: &now,
+	}
+	if err := user.SetPassword(password); err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.CreateUserWithIdentity(user, identity); err != nil {
+		return nil, err
+	}
+
+	s.audit.Record(ctx, selfEvent(user.ID, audit.ActionSignup))
+	s.recordLogin(ctx, user)
+
+	_ = s.email.SendWelcomeEmail(user.Email, user.Username)
+
+	return user, nil
+}
+
+// LinkIdentity attaches an external identity to a signed-in user.
+func (s *Service) LinkIdentity(ctx context.Context, userID uint, ext ExternalIdentity) error {
+	if identity, err := s.repo.GetIdentity(ext.Provider, ext.Subject); err == nil {
+		if identity.UserID == userID {
+			return nil
+		}
+		return errors.New("this account is already linked to another user")
+	}
+
+	if err := s.repo.CreateIdentity(&Identity{
+		UserID:   userID,
+		Provider: ext.Provider,
+		Subject:  ext.Subject,
+		Email:    ext.Email,
+	}); err != nil {
+		return err
+	}
+
+	s.audit.Record(ctx, audit.UserEvent(userID, audit.ActionIdentityLinked))
+	return nil
+}
+
+// claimUnverifiedAccount hands an account registered with an address nobody
+// verified to the owner the provider vouched for. Whoever registered it may
+// not own the address, so their password, second factor and sessions are
+// discarded.
+func (s *Service) claimUnverifiedAccount(user *User) error {
+	password, err := generateSecureToken(32)
+	if err != nil {
+		return err
+	}
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+	user.TOTPSecret = ""
+	user.TOTPEnabledAt = nil
+	user.TOTPLastStep = 0
+	if err := s.repo.UpdateUser(user); err != nil {
+		return err
+	}
+
+	if err := s.repo.DeleteRecoveryCodes(user.ID); err != nil {
+		return err
+	}
+	return s.repo.RevokeUserSessions(user.ID)
+}
+
+// availableUsername derives an unused username from the provider's
+// preferred username or the local part of the email address.
+func (s *Service) availableUsername(preferred, email string) (string, error) {
+	base := strings.ToLower(preferred)
+	if base == "" {
+		base = strings.ToLower(strings.SplitN(email, "@", 2)[0])
+	}
+	base = usernameCleaner.ReplaceAllString(base, "")
+	if len(base) < 3 {
+		base = "rider"
+	}
+
+	candidate := base
+	for i := 0; i < 10; i++ {
+		exists, err := s.repo.UsernameExists(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+
+		b := make([]byte, 2)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		candidate = base + hex.EncodeToString(b)
+	}
+
+	return "", errors.New("could not find an available username")
+}
+
+// recordLogin records a completed login. When a second factor is still due
+// the login is recorded once VerifyLoginMFA accepts it.
+func (s *Service) recordLogin(ctx context.Context, user *User) {
+	if user.HasTOTP() {
+		return
+	}
+	s.audit.Record(ctx, selfEvent(user.ID, audit.ActionLogin))
+}
+
+// selfEvent is an event a user caused on their own account without being
+// signed in, such as a login or following an emailed link.
+func selfEvent(userID uint, action string) audit.Event {
+	return audit.Event{ActorID: &userID, UserID: &userID, Action: action}
+}
+
+// issueActionToken stores a new single-use token for purpose and returns it.
+func (s *Service) issueActionToken(userID uint, purpose, data string, ttl time.Duration) (string, error) {
+	token, err := generateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	actionToken := &ActionToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		Token:     token,
+		Data:      data,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	if err := s.repo.CreateActionToken(actionToken); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Helper functions
+func isValidEmail(email string) bool {
+	regex := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+	return regex.MatchString(email)
+}
+
+func generateSecureToken(length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// loginBackoff is how long to wait after the last of failures consecutive
+// failed logins: nothing for the first few, then doubling up to a minute.
+func loginBackoff(failures int) time.Duration {
+	if failures < backoffAfterFailures {
+		return 0
+	}
+	delay := time.Second << (failures - backoffAfterFailures)
+	if delay > maxLoginBackoff || delay <= 0 {
+		return maxLoginBackoff
+	}
+	return delay
+}
+
+// hashRecoveryCode normalises a recovery code as typed by the user and
+// hashes it for storage.
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
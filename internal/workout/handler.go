@@ -2,8 +2,10 @@ package workout
 
 import (
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 
@@ -15,9 +17,9 @@ type Handler struct {
 	service *Service
 }
 
-func NewHandler() *Handler {
+func NewHandler(service *Service) *Handler {
 	return &Handler{
-		service: NewService(),
+		service: service,
 	}
 }
 
@@ -25,7 +27,7 @@ func NewHandler() *Handler {
 func (h *Handler) CreateWorkout(w http.ResponseWriter, r *http.Request) {
 	log.Printf("CreateWorkout handler called")
 	claims := r.Context().Value(middleware.UserContextKey).(*config.CustomClaims)
-	
+
 	if claims == nil {
 		log.Printf("Claims is nil")
 		w.Header().Set("Content-Type", "application/json")
@@ -37,14 +39,14 @@ func (h *Handler) CreateWorkout(w http.ResponseWriter, r *http.Request) {
 	log.Printf("UserID: %d", claims.UserID)
 
 	var req struct {
-		Title        string           `json:"title"`
-		Description  string           `json:"description"`
-		Type         string           `json:"type"`
+		Title         string           `json:"title"`
+		Description   string           `json:"description"`
+		Type          string           `json:"type"`
 		ScheduledDate string           `json:"scheduled_date"`
-		Duration     int              `json:"duration"`
-		Notes        string           `json:"notes"`
-		WorkoutData  *WorkoutDataJSON `json:"workout_data"`
-		FileType     string           `json:"file_type"`
+		Duration      int              `json:"duration"`
+		Notes         string           `json:"notes"`
+		WorkoutData   *WorkoutDataJSON `json:"workout_data"`
+		FileType      string           `json:"file_type"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -228,6 +230,7 @@ func (h *Handler) UpdateWorkout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before := *workout
 	if req.Title != "" {
 		workout.Title = req.Title
 	}
@@ -268,7 +271,7 @@ func (h *Handler) UpdateWorkout(w http.ResponseWriter, r *http.Request) {
 		workout.Notes = req.Notes
 	}
 
-	if err := h.service.repo.UpdateWorkout(workout); err != nil {
+	if err := h.service.UpdateWorkout(r.Context(), before, workout); err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update workout"})
@@ -292,7 +295,7 @@ func (h *Handler) DeleteWorkout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.service.DeleteWorkout(uint(id), claims.UserID); err != nil {
+	if err := h.service.DeleteWorkout(r.Context(), uint(id), claims.UserID); err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
@@ -341,8 +344,13 @@ func (h *Handler) UploadWorkoutFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	fileContent := make([]byte, handler.Size)
-	file.Read(fileContent)
+	fileContent, err := io.ReadAll(file)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to read file"})
+		return
+	}
 
 	// Parse ZWO file
 	parsedData, err := ParseZWO(fileContent)
@@ -360,6 +368,16 @@ func (h *Handler) UploadWorkoutFile(w http.ResponseWriter, r *http.Request) {
 		scheduledDate = time.Now()
 	}
 
+	// Keep the original file so it can be exported later
+	fileURL, err := SaveUpload(claims.UserID, handler.Filename, fileContent)
+	if err != nil {
+		log.Printf("Failed to store upload for user %d: %v", claims.UserID, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to store file"})
+		return
+	}
+
 	// Create workout with parsed data
 	workout := &Workout{
 		UserID:        claims.UserID,
@@ -370,6 +388,7 @@ func (h *Handler) UploadWorkoutFile(w http.ResponseWriter, r *http.Request) {
 		ScheduledDate: scheduledDate,
 		Duration:      parsedData.TotalDuration,
 		FileType:      "zwo",
+		FileURL:       fileURL,
 		WorkoutData: WorkoutDataJSON{
 			Name:          parsedData.Name,
 			Author:        parsedData.Author,
@@ -379,6 +398,7 @@ func (h *Handler) UploadWorkoutFile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := h.service.repo.CreateWorkout(workout); err != nil {
+		os.Remove(UploadPath(fileURL))
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create workout"})
@@ -388,4 +408,4 @@ func (h *Handler) UploadWorkoutFile(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(workout)
-}
\ No newline at end of file
+}
@@ -2,24 +2,25 @@ package workout
 
 import (
 	"errors"
-	"rideaware/pkg/database"
 	"time"
 	"gorm.io/gorm"
 )
 
-type Repository struct{}
+type Repository struct {
+	db *gorm.DB
+}
 
-func NewRepository() *Repository {
-	return &Repository{}
+func NewRepository(db *gorm.DB) *Repository {
+	return &Repository{db: db}
 }
 
 func (r *Repository) CreateWorkout(workout *Workout) error {
-	return database.DB.Create(workout).Error
+	return r.db.Create(workout).Error
 }
 
 func (r *Repository) GetWorkoutByID(id, userID uint) (*Workout, error) {
 	var workout Workout
-	if err := database.DB.Where("id = ? AND user_id = ?", id, userID).
+	if err := r.db.Where("id = ? AND user_id = ?", id, userID).
 		First(&workout).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, errors.New("workout not found")
@@ -31,7 +32,7 @@ func (r *Repository) GetWorkoutByID(id, userID uint) (*Workout, error) {
 
 func (r *Repository) GetUserWorkouts(userID uint) ([]Workout, error) {
 	var workouts []Workout
-	if err := database.DB.Where("user_id = ?", userID).
+	if err := r.db.Where("user_id = ?", userID).
 		Order("scheduled_date DESC").
 		Find(&workouts).Error; err != nil {
 		return nil, err
@@ -41,7 +42,7 @@ func (r *Repository) GetUserWorkouts(userID uint) ([]Workout, error) {
 
 func (r *Repository) GetWorkoutsByDateRange(userID uint, start, end time.Time) ([]Workout, error) {
 	var workouts []Workout
-	if err := database.DB.Where("user_id = ? AND scheduled_date BETWEEN ? AND ?", userID, start, end).
+	if err := r.db.Where("user_id = ? AND scheduled_date BETWEEN ? AND ?", userID, start, end).
 		Order("scheduled_date ASC").
 		Find(&workouts).Error; err != nil {
 		return nil, err
@@ -56,10 +57,10 @@ func (r *Repository) GetWorkoutsByMonth(userID uint, year, month int) ([]Workout
 }
 
 func (r *Repository) UpdateWorkout(workout *Workout) error {
-	return database.DB.Model(workout).Updates(workout).Error
+	return r.db.Model(workout).Updates(workout).Error
 }
 
 func (r *Repository) DeleteWorkout(id, userID uint) error {
-	return database.DB.Where("id = ? AND user_id = ?", id, userID).
+	return r.db.Where("id = ? AND user_id = ?", id, userID).
 		Delete(&Workout{}).Error
 }
\ No newline at end of file
@@ -1,17 +1,26 @@
 package workout
 
 import (
+	"context"
 	"errors"
+	"log"
+	"os"
 	"time"
+
+	"rideaware/internal/audit"
+
+	"gorm.io/gorm"
 )
 
 type Service struct {
-	repo *Repository
+	repo  *Repository
+	audit *audit.Service
 }
 
-func NewService() *Service {
+func NewService(db *gorm.DB, auditor *audit.Service) *Service {
 	return &Service{
-		repo: NewRepository(),
+		repo:  NewRepository(db),
+		audit: auditor,
 	}
 }
 
@@ -83,6 +92,39 @@ func (s *Service) UpdateWorkoutWithMetrics(id, userID uint, distance float64, av
 	return workout, nil
 }
 
-func (s *Service) DeleteWorkout(id, userID uint) error {
-	return s.repo.DeleteWorkout(id, userID)
-}
\ No newline at end of file
+// UpdateWorkout saves changes made to workout, recording them against the
+// state it had before.
+func (s *Service) UpdateWorkout(ctx context.Context, before Workout, workout *Workout) error {
+	if err := s.repo.UpdateWorkout(workout); err != nil {
+		return err
+	}
+
+	if changes := audit.Diff(before, workout); changes != nil {
+		event := audit.UserEvent(workout.UserID, audit.ActionWorkoutUpdated)
+		event.Changes = changes
+		s.audit.Record(ctx, event)
+	}
+	return nil
+}
+
+func (s *Service) DeleteWorkout(ctx context.Context, id, userID uint) error {
+	workout, err := s.repo.GetWorkoutByID(id, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.repo.DeleteWorkout(id, userID); err != nil {
+		return err
+	}
+
+	event := audit.UserEvent(userID, audit.ActionWorkoutDeleted)
+	event.Changes = audit.Diff(workout, nil)
+	s.audit.Record(ctx, event)
+
+	if path := UploadPath(workout.FileURL); path != "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove upload of workout %d: %v", id, err)
+		}
+	}
+	return nil
+}
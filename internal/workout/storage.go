@@ -0,0 +1,57 @@
+package workout
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// uploadDir is where original workout files are kept, one directory per user.
+var uploadDir = "uploads"
+
+// SetUploadDir configures where uploaded workout files are stored. An empty
+// value keeps the default.
+func SetUploadDir(dir string) {
+	if dir != "" {
+		uploadDir = dir
+	}
+}
+
+// SaveUpload stores an uploaded file and returns its key, the path relative
+// to the upload directory that is recorded as the workout's FileURL.
+func SaveUpload(userID uint, fileName string, content []byte) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	ext := strings.ToLower(filepath.Ext(fileName))
+	key := filepath.Join(fmt.Sprint(userID), hex.EncodeToString(b)+ext)
+
+	path := filepath.Join(uploadDir, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, content, 0o640); err != nil {
+		return "", err
+	}
+
+	return filepath.ToSlash(key), nil
+}
+
+// UploadPath returns where the file recorded as fileURL is stored, or an
+// empty string if the workout has no stored file.
+func UploadPath(fileURL string) string {
+	if fileURL == "" || strings.Contains(fileURL, "..") || filepath.IsAbs(fileURL) {
+		return ""
+	}
+	return filepath.Join(uploadDir, filepath.FromSlash(fileURL))
+}
+
+// RemoveUserUploads deletes every file uploaded by the user.
+func RemoveUserUploads(userID uint) error {
+	return os.RemoveAll(filepath.Join(uploadDir, fmt.Sprint(userID)))
+}
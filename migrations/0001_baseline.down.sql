@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS workouts;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS password_resets;
+DROP TABLE IF EXISTS profiles;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,93 @@
+-- Baseline: the schema AutoMigrate created before versioned migrations,
+-- when the server only had users, profiles, password resets, sessions and
+-- workouts. It is IF NOT EXISTS throughout, so a database AutoMigrate built
+-- only gets this version recorded; later migrations add everything since.
+
+CREATE TABLE IF NOT EXISTS users (
+    id bigserial,
+    username text NOT NULL,
+    email text NOT NULL,
+    password text NOT NULL,
+    is_active boolean DEFAULT true,
+    created_at timestamptz,
+    updated_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users (email);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users (username);
+
+CREATE TABLE IF NOT EXISTS profiles (
+    id bigserial,
+    user_id bigint NOT NULL,
+    first_name text DEFAULT '',
+    last_name text DEFAULT '',
+    bio text DEFAULT '',
+    profile_picture text DEFAULT '',
+    resting_hr bigint DEFAULT 0,
+    max_hr bigint DEFAULT 0,
+    ftp bigint DEFAULT 0,
+    weight decimal DEFAULT 0,
+    total_rides bigint DEFAULT 0,
+    total_distance decimal DEFAULT 0,
+    total_time bigint DEFAULT 0,
+    created_at timestamptz,
+    updated_at timestamptz,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_users_profile FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_profiles_user_id ON profiles (user_id);
+
+CREATE TABLE IF NOT EXISTS password_resets (
+    id bigserial,
+    user_id bigint NOT NULL,
+    token text NOT NULL,
+    expires_at timestamptz NOT NULL,
+    used_at timestamptz,
+    created_at timestamptz,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_users_password_resets FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_password_resets_token ON password_resets (token);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id bigserial,
+    user_id bigint NOT NULL,
+    token text NOT NULL,
+    expires_at timestamptz NOT NULL,
+    device_name text DEFAULT '',
+    user_agent text DEFAULT '',
+    ip_address text DEFAULT '',
+    created_at timestamptz,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_users_sessions FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions (expires_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sessions_token ON sessions (token);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+
+CREATE TABLE IF NOT EXISTS workouts (
+    id bigserial,
+    user_id bigint NOT NULL,
+    title text NOT NULL,
+    description text DEFAULT '',
+    type text DEFAULT '',
+    status text DEFAULT 'planned',
+    scheduled_date timestamptz,
+    duration bigint DEFAULT 0,
+    distance decimal DEFAULT 0,
+    elev_gain bigint DEFAULT 0,
+    avg_power bigint DEFAULT 0,
+    avg_hr bigint DEFAULT 0,
+    max_power bigint DEFAULT 0,
+    max_hr bigint DEFAULT 0,
+    calories_burned bigint DEFAULT 0,
+    file_type text DEFAULT '',
+    file_url text DEFAULT '',
+    workout_data jsonb,
+    notes text,
+    created_at timestamptz,
+    updated_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_workouts_scheduled_date ON workouts (scheduled_date);
+CREATE INDEX IF NOT EXISTS idx_workouts_user_id ON workouts (user_id);
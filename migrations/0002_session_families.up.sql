@@ -0,0 +1,9 @@
+-- Refresh token rotation: sessions of one login share a family, and a
+-- rotated or revoked session can't be refreshed. Sessions from before had
+-- no family, so each gets one of its own.
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS family_id text NOT NULL DEFAULT '';
+UPDATE sessions SET family_id = 'legacy-' || id WHERE family_id = '';
+ALTER TABLE sessions ALTER COLUMN family_id DROP DEFAULT;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS rotated_at timestamptz;
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS revoked_at timestamptz;
+CREATE INDEX IF NOT EXISTS idx_sessions_family_id ON sessions (family_id);
@@ -0,0 +1,29 @@
+-- Failed login counters and the emailed single-use action tokens, such as
+-- account unlock links.
+
+CREATE TABLE IF NOT EXISTS action_tokens (
+    id bigserial,
+    user_id bigint NOT NULL,
+    purpose text NOT NULL,
+    token text NOT NULL,
+    data text DEFAULT '',
+    expires_at timestamptz NOT NULL,
+    used_at timestamptz,
+    created_at timestamptz,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_users_action_tokens FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_action_tokens_user_id ON action_tokens (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_action_tokens_token ON action_tokens (token);
+CREATE INDEX IF NOT EXISTS idx_action_tokens_purpose ON action_tokens (purpose);
+
+CREATE TABLE IF NOT EXISTS login_throttles (
+    id bigserial,
+    key text NOT NULL,
+    failures bigint NOT NULL DEFAULT 0,
+    last_failure_at timestamptz NOT NULL,
+    locked_until timestamptz,
+    updated_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_login_throttles_key ON login_throttles (key);
@@ -0,0 +1,14 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at timestamptz;
+
+-- Accounts created before email verification existed were never sent a
+-- verification link. Every signup since then has a verify_email action
+-- token, so accounts without one are the old ones; they count as verified
+-- from when they were created.
+UPDATE users
+SET email_verified_at = created_at
+WHERE email_verified_at IS NULL
+  AND NOT EXISTS (
+    SELECT 1 FROM action_tokens
+    WHERE action_tokens.user_id = users.id
+      AND action_tokens.purpose = 'verify_email'
+  );
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS identities (
+    id bigserial,
+    user_id bigint NOT NULL,
+    provider text NOT NULL,
+    subject text NOT NULL,
+    email text DEFAULT '',
+    created_at timestamptz,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_users_identities FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_identity_provider_subject ON identities (provider, subject);
+CREATE INDEX IF NOT EXISTS idx_identities_user_id ON identities (user_id);
+
+CREATE TABLE IF NOT EXISTS oauth_login_states (
+    id bigserial,
+    state text NOT NULL,
+    provider text NOT NULL,
+    nonce text NOT NULL,
+    code_verifier text NOT NULL,
+    secret_hash text NOT NULL,
+    user_id bigint,
+    expires_at timestamptz NOT NULL,
+    created_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_oauth_login_states_expires_at ON oauth_login_states (expires_at);
+CREATE INDEX IF NOT EXISTS idx_oauth_login_states_user_id ON oauth_login_states (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_oauth_login_states_state ON oauth_login_states (state);
@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'athlete';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS permissions text NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_for timestamptz;
+CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled_for ON users (deletion_scheduled_for);
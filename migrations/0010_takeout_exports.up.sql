@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS takeout_exports (
+    id bigserial,
+    user_id bigint NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    token text NOT NULL,
+    file_path text DEFAULT '',
+    size bigint DEFAULT 0,
+    error text DEFAULT '',
+    expires_at timestamptz,
+    completed_at timestamptz,
+    created_at timestamptz,
+    updated_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_takeout_exports_token ON takeout_exports (token);
+CREATE INDEX IF NOT EXISTS idx_takeout_exports_status ON takeout_exports (status);
+CREATE INDEX IF NOT EXISTS idx_takeout_exports_user_id ON takeout_exports (user_id);
@@ -0,0 +1 @@
+-- The table predates this migration on most databases, so it is kept.
@@ -0,0 +1,19 @@
+-- Databases from before versioned migrations already have this table, as
+-- the server used to AutoMigrate equipment.Equipment. Fresh ones get the
+-- columns of profile.Equipment, which takeout and account purging use.
+
+CREATE TABLE IF NOT EXISTS equipment (
+    id bigserial,
+    user_id bigint NOT NULL,
+    name text NOT NULL,
+    type text NOT NULL,
+    brand text DEFAULT '',
+    model text DEFAULT '',
+    weight decimal DEFAULT 0,
+    notes text DEFAULT '',
+    active boolean DEFAULT true,
+    created_at timestamptz,
+    updated_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_equipment_user_id ON equipment (user_id);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS audit_events (
+    id bigserial,
+    actor_id bigint,
+    user_id bigint,
+    action text NOT NULL,
+    ip_address text DEFAULT '',
+    user_agent text DEFAULT '',
+    changes jsonb,
+    created_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_audit_events_user_id ON audit_events (user_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events (actor_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events (created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events (action);
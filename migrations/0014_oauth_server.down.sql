@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_sessions_client_id;
+ALTER TABLE sessions DROP COLUMN IF EXISTS scopes;
+ALTER TABLE sessions DROP COLUMN IF EXISTS client_id;
+DROP TABLE IF EXISTS oauth_authorization_codes;
+DROP TABLE IF EXISTS oauth_clients;
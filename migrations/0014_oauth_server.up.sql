@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id bigserial,
+    user_id bigint NOT NULL,
+    client_id text NOT NULL,
+    secret_hash text DEFAULT '',
+    name text NOT NULL,
+    redirect_uris text NOT NULL,
+    scopes text NOT NULL,
+    revoked_at timestamptz,
+    created_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_oauth_clients_client_id ON oauth_clients (client_id);
+CREATE INDEX IF NOT EXISTS idx_oauth_clients_user_id ON oauth_clients (user_id);
+
+CREATE TABLE IF NOT EXISTS oauth_authorization_codes (
+    id bigserial,
+    user_id bigint NOT NULL,
+    client_id text NOT NULL,
+    code_hash text NOT NULL,
+    redirect_uri text NOT NULL,
+    scopes text NOT NULL,
+    code_challenge text NOT NULL,
+    family_id text DEFAULT '',
+    expires_at timestamptz NOT NULL,
+    used_at timestamptz,
+    created_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_oauth_authorization_codes_user_id ON oauth_authorization_codes (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_oauth_authorization_codes_code_hash ON oauth_authorization_codes (code_hash);
+CREATE INDEX IF NOT EXISTS idx_oauth_authorization_codes_client_id ON oauth_authorization_codes (client_id);
+
+-- Sessions an OAuth2 client holds on behalf of a user.
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS client_id text DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS scopes text DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_sessions_client_id ON sessions (client_id);
@@ -0,0 +1,2 @@
+-- The method and path of a request made with an impersonation token.
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS request text DEFAULT '';
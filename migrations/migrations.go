@@ -0,0 +1,9 @@
+// Package migrations embeds the versioned SQL migrations for the database.
+// Each version NNNN has a NNNN_name.up.sql file and a matching
+// NNNN_name.down.sql file that reverts it.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
@@ -0,0 +1,286 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// migrationLockID keys the advisory lock held while migrating, so servers
+// starting together don't apply the same migration twice.
+const migrationLockID int64 = 7_302_941_517
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one version of the schema, read from NNNN_name.up.sql and
+// NNNN_name.down.sql.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// MigrationStatus is a migration and when it was applied, if it was.
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+type appliedMigration struct {
+	Version   int64
+	AppliedAt time.Time
+}
+
+// Migrator applies versioned migrations and records them in the
+// schema_migrations table.
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+// NewMigrator reads the migrations in the top directory of files.
+func NewMigrator(db *gorm.DB, files fs.FS) (*Migrator, error) {
+	entries, err := fs.ReadDir(files, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := map[int64]*Migration{}
+	found := map[string]bool{}
+	for _, entry := range entries {
+		match := migrationFile.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+		data, err := fs.ReadFile(files, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+		found[m.String()+"."+match[3]] = true
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		for _, direction := range []string{"up", "down"} {
+			if !found[m.String()+"."+direction] {
+				return nil, fmt.Errorf("migration %s has no .%s.sql file", m, direction)
+			}
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Status lists every known migration in order.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.locked(ctx, func(conn *gorm.DB) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			status := MigrationStatus{Migration: migration}
+			if at, ok := applied[migration.Version]; ok {
+				status.AppliedAt = &at
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Pending lists the migrations that have not been applied.
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending = append(pending, status.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies every pending migration in order and returns them. Each one
+// runs in its own transaction, so a failure keeps the ones before it.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *gorm.DB) error {
+		applied, err := m.applied(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err := m.up(conn, migration); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the latest applied migration and returns it, or nil when
+// nothing is applied.
+func (m *Migrator) Down(ctx context.Context) (*Migration, error) {
+	var done *Migration
+	err := m.locked(ctx, func(conn *gorm.DB) error {
+		migration, err := m.latest(conn)
+		if err != nil || migration == nil {
+			return err
+		}
+		if err := m.down(conn, *migration); err != nil {
+			return err
+		}
+		done = migration
+		return nil
+	})
+	return done, err
+}
+
+// Redo reverts the latest applied migration and applies it again.
+func (m *Migrator) Redo(ctx context.Context) (*Migration, error) {
+	var done *Migration
+	err := m.locked(ctx, func(conn *gorm.DB) error {
+		migration, err := m.latest(conn)
+		if err != nil || migration == nil {
+			return err
+		}
+		if err := m.down(conn, *migration); err != nil {
+			return err
+		}
+		if err := m.up(conn, *migration); err != nil {
+			return err
+		}
+		done = migration
+		return nil
+	})
+	return done, err
+}
+
+// locked runs fn on a single connection holding the migration lock. The
+// lock belongs to the session, so it must be taken and released on the
+// same connection.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *gorm.DB) error) error {
+	return m.db.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("SELECT pg_advisory_lock(?)", migrationLockID).Error; err != nil {
+			return fmt.Errorf("failed to lock migrations: %w", err)
+		}
+		// Unlock even if ctx was cancelled, or the lock stays with the
+		// pooled connection.
+		defer conn.WithContext(context.WithoutCancel(ctx)).
+			Exec("SELECT pg_advisory_unlock(?)", migrationLockID)
+
+		if err := conn.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint PRIMARY KEY,
+			name text NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`).Error; err != nil {
+			return fmt.Errorf("failed to create schema_migrations: %w", err)
+		}
+
+		return fn(conn)
+	})
+}
+
+func (m *Migrator) applied(conn *gorm.DB) (map[int64]time.Time, error) {
+	var rows []appliedMigration
+	if err := conn.Table("schema_migrations").Select("version, applied_at").Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+
+	applied := make(map[int64]time.Time, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+	return applied, nil
+}
+
+// latest returns the most recently applied migration, or nil when none is.
+func (m *Migrator) latest(conn *gorm.DB) (*Migration, error) {
+	var rows []appliedMigration
+	if err := conn.Table("schema_migrations").Select("version, applied_at").
+		Order("version DESC").Limit(1).Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	for _, migration := range m.migrations {
+		if migration.Version == rows[0].Version {
+			return &migration, nil
+		}
+	}
+	return nil, fmt.Errorf("the latest applied migration %d is not known to this build", rows[0].Version)
+}
+
+func (m *Migrator) up(conn *gorm.DB, migration Migration) error {
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(migration.Up).Error; err != nil {
+			return err
+		}
+		return tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)",
+			migration.Version, migration.Name).Error
+	})
+	if err != nil {
+		return fmt.Errorf("migration %s failed: %w", migration, err)
+	}
+	return nil
+}
+
+func (m *Migrator) down(conn *gorm.DB, migration Migration) error {
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(migration.Down).Error; err != nil {
+			return err
+		}
+		return tx.Exec("DELETE FROM schema_migrations WHERE version = ?", migration.Version).Error
+	})
+	if err != nil {
+		return fmt.Errorf("reverting migration %s failed: %w", migration, err)
+	}
+	return nil
+}
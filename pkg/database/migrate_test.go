@@ -0,0 +1,233 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"rideaware/migrations"
+)
+
+// testDB connects to TEST_DATABASE_URL with a fresh schema first on the
+// search path, and drops the schema when the test ends. Tests that need it
+// are skipped when the variable is unset.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		t.Fatalf("TEST_DATABASE_URL must be a postgres:// URL")
+	}
+
+	admin, err := Init(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Close(admin) })
+
+	schema := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano())
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	db, err := Init(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Close(db) })
+	return db
+}
+
+func testMigrator(t *testing.T, db *gorm.DB) *Migrator {
+	t.Helper()
+
+	migrator, err := NewMigrator(db, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrator
+}
+
+func tables(t *testing.T, db *gorm.DB) []string {
+	t.Helper()
+
+	var names []string
+	if err := db.Raw(`SELECT table_name FROM information_schema.tables
+		WHERE table_schema = current_schema() ORDER BY table_name`).Scan(&names).Error; err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestNewMigratorReadsEmbeddedMigrations(t *testing.T) {
+	migrator := testMigrator(t, nil)
+	if len(migrator.migrations) == 0 {
+		t.Fatal("no migrations found")
+	}
+	for i, m := range migrator.migrations {
+		if m.Version != int64(i+1) {
+			t.Errorf("migration %s is number %d, want versions without gaps", m, i+1)
+		}
+		if m.Up == "" {
+			t.Errorf("migration %s has an empty up file", m)
+		}
+	}
+	if got := migrator.migrations[0].String(); got != "0001_baseline" {
+		t.Errorf("first migration is %s, want 0001_baseline", got)
+	}
+}
+
+func TestMigrateUpDownRedo(t *testing.T) {
+	db := testDB(t)
+	migrator := testMigrator(t, db)
+	ctx := context.Background()
+
+	applied, err := migrator.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrator.migrations) {
+		t.Fatalf("applied %d migrations, want %d", len(applied), len(migrator.migrations))
+	}
+	upTables := tables(t, db)
+
+	pending, err := migrator.Pending(ctx)
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("Pending = (%v, %v), want none", pending, err)
+	}
+	applied, err = migrator.Up(ctx)
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("second Up = (%v, %v), want nothing to do", applied, err)
+	}
+
+	redone, err := migrator.Redo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest := migrator.migrations[len(migrator.migrations)-1]; redone == nil || redone.Version != latest.Version {
+		t.Errorf("Redo = %v, want %s", redone, latest)
+	}
+	if got := tables(t, db); !reflect.DeepEqual(got, upTables) {
+		t.Errorf("tables after Redo = %v, want %v", got, upTables)
+	}
+
+	// Revert everything, one migration at a time
+	for i := len(migrator.migrations) - 1; i >= 0; i-- {
+		reverted, err := migrator.Down(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reverted == nil || reverted.Version != migrator.migrations[i].Version {
+			t.Fatalf("Down = %v, want %s", reverted, migrator.migrations[i])
+		}
+	}
+	reverted, err := migrator.Down(ctx)
+	if err != nil || reverted != nil {
+		t.Fatalf("Down with nothing applied = (%v, %v), want nil", reverted, err)
+	}
+
+	// 0011_equipment keeps its table, which may predate migrations
+	if got, want := tables(t, db), []string{"equipment", "schema_migrations"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tables after reverting everything = %v, want %v", got, want)
+	}
+
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Up after reverting everything: %v", err)
+	}
+	if got := tables(t, db); !reflect.DeepEqual(got, upTables) {
+		t.Errorf("tables after migrating up again = %v, want %v", got, upTables)
+	}
+}
+
+// TestMigrateUpFromAutoMigrateSchema starts from the schema AutoMigrate built
+// before versioned migrations, with data in it.
+func TestMigrateUpFromAutoMigrateSchema(t *testing.T) {
+	db := testDB(t)
+	migrator := testMigrator(t, db)
+	ctx := context.Background()
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	setup := []string{
+		migrator.migrations[0].Up,
+		// AutoMigrate also created the equipment table
+		`CREATE TABLE equipment (id bigserial PRIMARY KEY, user_id bigint NOT NULL, name text NOT NULL)`,
+	}
+	for _, sql := range setup {
+		if err := db.Exec(sql).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Exec(`INSERT INTO users (username, email, password, created_at, updated_at)
+		VALUES ('alice', 'alice@example.com', 'hash', ?, ?)`, created, created).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(`INSERT INTO sessions (user_id, token, expires_at, created_at)
+		SELECT id, 'refresh-1', ?, ? FROM users`, created.Add(time.Hour), created).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(`INSERT INTO equipment (user_id, name) SELECT id, 'Road bike' FROM users`).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var user struct {
+		Role            string
+		EmailVerifiedAt *time.Time
+	}
+	if err := db.Raw("SELECT role, email_verified_at FROM users").Scan(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != "athlete" {
+		t.Errorf("existing user has role %q, want athlete", user.Role)
+	}
+	if user.EmailVerifiedAt == nil || !user.EmailVerifiedAt.Equal(created) {
+		t.Errorf("existing user verified at %v, want %v", user.EmailVerifiedAt, created)
+	}
+
+	var families []string
+	if err := db.Raw("SELECT family_id FROM sessions").Scan(&families).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0] == "" {
+		t.Errorf("existing session families = %q, want one of its own", families)
+	}
+
+	var equipment []string
+	if err := db.Raw("SELECT name FROM equipment").Scan(&equipment).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(equipment, []string{"Road bike"}) {
+		t.Errorf("equipment = %v, want the existing row kept", equipment)
+	}
+
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notApplied []string
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			notApplied = append(notApplied, status.String())
+		}
+	}
+	if len(notApplied) > 0 {
+		t.Errorf("migrations not applied: %v", notApplied)
+	}
+}
@@ -0,0 +1,24 @@
+package database
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
+
+// UnitOfWork runs operations that span several repositories, or several
+// services, in one transaction.
+type UnitOfWork struct {
+	db *gorm.DB
+}
+
+func NewUnitOfWork(db *gorm.DB) *UnitOfWork {
+	return &UnitOfWork{db: db}
+}
+
+// Do runs fn in a transaction. Repositories and services rebound to tx with
+// their WithTx method share it. The transaction commits when fn returns nil
+// and rolls back when it returns an error or panics.
+func (u *UnitOfWork) Do(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	return u.db.WithContext(ctx).Transaction(fn)
+}
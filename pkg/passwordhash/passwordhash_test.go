@@ -0,0 +1,117 @@
+package passwordhash
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	encoded, err := Hash("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=65536,t=3,p=2$") {
+		t.Errorf("unexpected encoding %q", encoded)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		wantOK   bool
+	}{
+		{"correct password", "correct horse battery staple", true},
+		{"wrong password", "correct horse battery stapler", false},
+		{"empty password", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, needsRehash, err := Verify(tt.password, encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOK {
+				t.Errorf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if needsRehash {
+				t.Error("a hash made with Current needs a rehash")
+			}
+		})
+	}
+}
+
+func TestHashUsesRandomSalt(t *testing.T) {
+	a, err := Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Error("two hashes of the same password are equal")
+	}
+}
+
+func TestVerifyBcrypt(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, needsRehash, err := Verify("password", string(legacy))
+	if err != nil || !ok || !needsRehash {
+		t.Errorf("Verify = (%v, %v, %v), want (true, true, nil)", ok, needsRehash, err)
+	}
+
+	ok, needsRehash, err = Verify("wrong", string(legacy))
+	if err != nil || ok || needsRehash {
+		t.Errorf("Verify = (%v, %v, %v), want (false, false, nil)", ok, needsRehash, err)
+	}
+}
+
+func TestVerifyWeakerParamsNeedRehash(t *testing.T) {
+	current := Current
+	Current = Params{Memory: 8 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	weak, err := Hash("password")
+	Current = current
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, needsRehash, err := Verify("password", weak)
+	if err != nil || !ok || !needsRehash {
+		t.Errorf("Verify = (%v, %v, %v), want (true, true, nil)", ok, needsRehash, err)
+	}
+}
+
+func TestVerifyInvalidHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"empty", ""},
+		{"plain text", "password"},
+		{"other algorithm", "$argon2i$v=19$m=65536,t=3,p=2$c2FsdHNhbHQ$a2V5a2V5"},
+		{"missing parts", "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHQ"},
+		{"bad params", "$argon2id$v=19$m=x,t=3,p=2$c2FsdHNhbHQ$a2V5a2V5"},
+		{"zero params", "$argon2id$v=19$m=0,t=3,p=2$c2FsdHNhbHQ$a2V5a2V5"},
+		{"bad salt", "$argon2id$v=19$m=65536,t=3,p=2$!!!$a2V5a2V5"},
+		{"empty key", "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHQ$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, _, err := Verify("password", tt.encoded)
+			if ok || !errors.Is(err, ErrInvalidHash) {
+				t.Errorf("Verify = (%v, %v), want ErrInvalidHash", ok, err)
+			}
+		})
+	}
+
+	if _, _, err := Verify("password", "$argon2id$v=16$m=65536,t=3,p=2$c2FsdHNhbHQ$a2V5a2V5"); err == nil {
+		t.Error("Verify accepted an unsupported argon2 version")
+	}
+}
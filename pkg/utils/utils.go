@@ -2,7 +2,9 @@ package utils
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
+	"strings"
 )
 
 func JSONResponse(w http.ResponseWriter, code int, payload interface{}) {
@@ -13,4 +15,60 @@ func JSONResponse(w http.ResponseWriter, code int, payload interface{}) {
 
 func JSONError(w http.ResponseWriter, code int, message string) {
 	JSONResponse(w, code, map[string]string{"error": message})
-}
\ No newline at end of file
+}
+
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies configures the CIDRs whose X-Forwarded-For header
+// ClientIP will honour.
+func SetTrustedProxies(cidrs []string) error {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, ipNet)
+	}
+	trustedProxies = nets
+	return nil
+}
+
+// ClientIP returns the address of the client that sent r. X-Forwarded-For is
+// only consulted when the direct peer is a trusted proxy.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" {
+			continue
+		}
+		if !isTrustedProxy(ip) {
+			return ip
+		}
+		host = ip
+	}
+	return host
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}